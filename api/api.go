@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,22 +20,24 @@ var dataPath = "./data/"
 const reservedBucket = "kvrest-system-internal"
 
 func createBucket(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		return err
+		return createUserBucket(tx, path)
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -40,98 +45,170 @@ func createBucket(w http.ResponseWriter, r *http.Request) {
 }
 
 func setKey(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
-	key := vars["key"]
+	key := mux.Vars(r)["key"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var value map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+	contentType, err := parseContentType(r.Header.Get("Content-Type"))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	valueBytes, err := json.Marshal(value)
+
+	// Values are stored exactly as sent, so any JSON document is accepted
+	// and object keys keep their original order. Other media types are
+	// stored as opaque bytes together with their Content-Type.
+	valueBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if contentType == "" && !json.Valid(valueBytes) {
+		http.Error(w, "Value must be a valid JSON document", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseTTL(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	rec := &record{ContentType: contentType, ExpiresAt: expiresAt, Value: valueBytes}
 
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+		bucket := getBucket(tx, path)
 		if bucket == nil {
 			return bbolt.ErrBucketNotFound
 		}
-		return bucket.Put([]byte(key), valueBytes)
+		current, err := getRecord(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, current); err != nil {
+			return err
+		}
+		return putRecord(bucket, path, []byte(key), rec)
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
+	w.Header().Set("ETag", rec.etag())
 	w.WriteHeader(http.StatusOK)
 }
 
 func getValue(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
-	key := vars["key"]
+	key := mux.Vars(r)["key"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// An optional JSON Pointer selects a subtree of a JSON value.
+	pointer, err := parsePointer(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
-	var value []byte
+	var rec *record
 	err = db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+		bucket := getBucket(tx, path)
 		if bucket == nil {
 			return bbolt.ErrBucketNotFound
 		}
-		value = bucket.Get([]byte(key))
-		return nil
+		stored, err := getRecord(bucket, []byte(key))
+		if stored != nil {
+			rec = stored.clone()
+		}
+		return err
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	if value == nil {
+	if rec == nil {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(value)
+	etag := rec.etag()
+	w.Header().Set("ETag", etag)
+	// If-Match is evaluated before If-None-Match (RFC 7232, section 6).
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagListMatches(ifMatch, etag) {
+		http.Error(w, errPreconditionFailed.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body := rec.Value
+	if pointer != nil {
+		if rec.ContentType != "" {
+			http.Error(w, errNotJSON.Error(), http.StatusConflict)
+			return
+		}
+		if body, err = selectSubtree(rec.Value, pointer); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", rec.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
 }
 
 func deleteKey(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
-	key := vars["key"]
+	key := mux.Vars(r)["key"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+		bucket := getBucket(tx, path)
 		if bucket == nil {
 			return bbolt.ErrBucketNotFound
 		}
-		return bucket.Delete([]byte(key))
+		current, err := getRecord(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, current); err != nil {
+			return err
+		}
+		return deleteRecord(bucket, path, []byte(key))
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -139,21 +216,30 @@ func deleteKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteBucket(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		return tx.DeleteBucket([]byte(bucketName))
+		if err := deleteBucketPath(tx, path); err != nil {
+			return err
+		}
+		if err := dropBucketAreas(tx, path); err != nil {
+			return err
+		}
+		return publishReset(tx, path)
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -161,17 +247,17 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 }
 
 func listBuckets(w http.ResponseWriter, r *http.Request) {
-	db, err := openDb(r)
+	db, release, err := openDb(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	var buckets []string
 	err = db.View(func(tx *bbolt.Tx) error {
 		return tx.ForEach(func(bucketName []byte, _ *bbolt.Bucket) error {
-			if string(bucketName) != reservedBucket {
+			if string(bucketName) != reservedBucket && allowed(r, [][]byte{bucketName}, false) {
 				buckets = append(buckets, string(bucketName))
 			}
 			return nil
@@ -187,61 +273,141 @@ func listBuckets(w http.ResponseWriter, r *http.Request) {
 }
 
 func listKeys(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := openDb(r)
+	kr, err := parseKeyRange(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
-	var keys []string
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var response keyListResponse
+	now := time.Now()
 	err = db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+		bucket := getBucket(tx, path)
 		if bucket == nil {
 			return bbolt.ErrBucketNotFound
 		}
-		return bucket.ForEach(func(k, v []byte) error {
-			keys = append(keys, string(k))
-			return nil
+		next, err := kr.each(bucket.Cursor(), func(k, v []byte) (bool, error) {
+			if v == nil {
+				response.Buckets = append(response.Buckets, string(k))
+				return true, nil
+			}
+			if isExpired(v, now) {
+				return false, nil
+			}
+			response.Keys = append(response.Keys, string(k))
+			return true, nil
 		})
+		response.Next = string(next)
+		return err
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string][]string{"keys": keys})
+	json.NewEncoder(w).Encode(response)
+}
+
+// keyListResponse is a page of a bucket: its keys and, separately, its
+// child buckets. Next is set when more entries follow and is passed back
+// as the after parameter to fetch the next page.
+type keyListResponse struct {
+	Keys    []string `json:"keys"`
+	Buckets []string `json:"buckets,omitempty"`
+	Next    string   `json:"next,omitempty"`
 }
 
 func RegisterRoutes(r *mux.Router) {
-	r.HandleFunc("/{bucketName}", createBucket).Methods("PUT")
-	r.HandleFunc("/{bucketName}", deleteBucket).Methods("DELETE")
+	// A bucket is addressed either by a single name (/users) or by a
+	// slash-separated path of nested buckets ending in a slash (/app/users/).
+	// Anything else ending in a name addresses a key.
+	const bucket = "/{bucketPath:[^/]+}"
+	const nested = "/{bucketPath:.+}/"
+	const parent = "/{bucketPath:.+}"
+
 	r.HandleFunc("/buckets", listBuckets).Methods("POST")
-	r.HandleFunc("/{bucketName}/{key}", setKey).Methods("PUT")
-	r.HandleFunc("/{bucketName}/{key}", getValue).Methods("GET")
-	r.HandleFunc("/{bucketName}/{key}", deleteKey).Methods("DELETE")
-	r.HandleFunc("/{bucketName}", listKeys).Methods("GET")
+	r.HandleFunc("/_txn", runTransaction).Methods("POST")
+	r.HandleFunc("/_stats", getStoreStats).Methods("GET")
+	r.HandleFunc("/_tokens", createToken).Methods("POST")
+	r.HandleFunc("/_tokens", listTokens).Methods("GET")
+	r.HandleFunc("/_tokens/{id}", revokeToken).Methods("DELETE")
+	r.HandleFunc("/_keys", createApiKey).Methods("POST")
+	r.HandleFunc("/_keys", listApiKeys).Methods("GET")
+	r.HandleFunc("/_keys/_rotate", rotateApiKey).Methods("POST")
+	r.HandleFunc("/_keys/{id}", revokeApiKey).Methods("DELETE")
+	r.HandleFunc("/_sign", signURL).Methods("POST")
+	r.HandleFunc("/_sign", revokeSignedURLs).Methods("DELETE")
+	r.HandleFunc("/_ws", serveWebSocket).Methods("GET")
+	for _, path := range []string{bucket, nested} {
+		r.HandleFunc(path, createBucket).Methods("PUT")
+		r.HandleFunc(path, deleteBucket).Methods("DELETE")
+		r.HandleFunc(path, listKeys).Methods("GET")
+	}
+	r.HandleFunc(parent+"/_mget", batchGet).Methods("POST")
+	r.HandleFunc(parent+"/_mput", batchPut).Methods("POST")
+	r.HandleFunc(parent+"/_mdelete", batchDelete).Methods("POST")
+	r.HandleFunc(parent+"/_scan", scanBucket).Methods("GET")
+	r.HandleFunc(parent+"/_query", queryBucket).Methods("POST")
+	r.HandleFunc(parent+"/_changes", streamChanges).Methods("GET")
+	r.HandleFunc(parent+"/_stats", getBucketStats).Methods("GET")
+	r.HandleFunc(parent+"/_rename", renameBucket).Methods("POST")
+	r.HandleFunc(parent+"/_copy", copyBucket).Methods("POST")
+	r.HandleFunc(parent+"/_indexes/_rebuild", rebuildIndexes).Methods("POST")
+	r.HandleFunc(parent+"/_indexes", createIndex).Methods("POST")
+	r.HandleFunc(parent+"/_indexes", listIndexes).Methods("GET")
+	r.HandleFunc(parent+"/_indexes", dropIndex).Methods("DELETE")
+	r.HandleFunc(parent+"/_schema/_validate", validateBucket).Methods("POST")
+	r.HandleFunc(parent+"/_schema", setSchema).Methods("PUT")
+	r.HandleFunc(parent+"/_schema", getSchema).Methods("GET")
+	r.HandleFunc(parent+"/_schema", deleteSchema).Methods("DELETE")
+	r.HandleFunc(parent+"/{key}/_incr", incrementKey).Methods("POST")
+	r.HandleFunc(parent+"/{key}", setKey).Methods("PUT")
+	r.HandleFunc(parent+"/{key}", getValue).Methods("GET", "HEAD")
+	r.HandleFunc(parent+"/{key}", deleteKey).Methods("DELETE")
+	r.HandleFunc(parent+"/{key}", patchKey).Methods("PATCH")
 }
 
 func ApiKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("API-KEY")
+		apiKey := requestApiKey(r)
 		if apiKey == "" {
 			http.Error(w, "Missing API key", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		t, tok, err := authenticate(apiKey)
+		if err == errInvalidApiKey {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := checkAccess(r, tok); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, withToken(withTenant(r, t), tok))
 	})
 }
 
 func DisableSystemBucketMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		bucketName := vars["bucketName"]
+		bucketName, _, _ := strings.Cut(mux.Vars(r)["bucketPath"], "/")
 
 		if bucketName == reservedBucket {
 			http.Error(w, "Bucket name 'system' not allowed", http.StatusMethodNotAllowed)
@@ -254,21 +420,79 @@ func DisableSystemBucketMiddleware(next http.Handler) http.Handler {
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		log.Printf("Started %s %s for %s", r.Method, r.RequestURI, r.RemoteAddr)
+		uri := loggedURI(r)
+		log.Printf("Started %s %s for %s", r.Method, uri, r.RemoteAddr)
 
 		next.ServeHTTP(w, r)
 
-		log.Printf("Completed %s %s in %v", r.Method, r.RequestURI, time.Since(start))
+		log.Printf("Completed %s %s in %v", r.Method, uri, time.Since(start))
 	})
 }
 
-func openDb(r *http.Request) (*bbolt.DB, error) {
-	apiKey := r.Header.Get("API-KEY")
-	dbFile := filepath.Join(dataPath, apiKey+".db")
+// loggedURI returns the request URI without the query of a signed URL,
+// whose signature is as good as a key.
+func loggedURI(r *http.Request) string {
+	if strings.Contains(r.URL.Path, "/_signed/") && r.URL.RawQuery != "" {
+		return r.URL.EscapedPath() + "?[redacted]"
+	}
+	return r.RequestURI
+}
 
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
-		return nil, err
+// errorStatus maps an error returned from a transaction to the HTTP status
+// it should be reported with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errReservedName):
+		return http.StatusBadRequest
+	case errors.Is(err, bbolt.ErrBucketNotFound),
+		errors.Is(err, errKeyNotFound),
+		errors.Is(err, errIndexNotFound),
+		errors.Is(err, errSchemaNotFound),
+		errors.Is(err, errTokenNotFound),
+		errors.Is(err, errApiKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, bbolt.ErrIncompatibleValue),
+		errors.Is(err, errNotANumber),
+		errors.Is(err, errNotJSON),
+		errors.Is(err, errPathNotFound),
+		errors.Is(err, errNotUnique),
+		errors.Is(err, errBucketExists),
+		errors.Is(err, errPrimaryKey),
+		errors.Is(err, errPatchTestFailed):
+		return http.StatusConflict
+	case errors.Is(err, errPatchCannotApply),
+		errors.Is(err, errSchemaViolation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errInvalidApiKey):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	return bbolt.Open(dbFile, 0666, nil)
+// openDb returns the shared handle for the caller's store. The handle is
+// owned by the pool: callers must call release instead of closing it.
+func openDb(r *http.Request) (*bbolt.DB, func(), error) {
+	t, ok := tenantFromRequest(r)
+	if !ok {
+		return nil, nil, errInvalidApiKey
+	}
+	db, release, err := pool.acquire(t.path)
+	if os.IsNotExist(err) {
+		// The store was renamed or removed after the key was resolved. After
+		// a rotation the key may still be valid for the renamed store.
+		t, _, err = authenticate(requestApiKey(r))
+		if err != nil {
+			return nil, nil, errInvalidApiKey
+		}
+		db, release, err = pool.acquire(t.path)
+		if os.IsNotExist(err) {
+			return nil, nil, errInvalidApiKey
+		}
+	}
+	return db, release, err
 }
@@ -1,21 +1,30 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.etcd.io/bbolt"
 )
 
 var tempDir string
 var apiKey string
-var routers = mux.NewRouter()
+var routers *mux.Router
 
 // setupDatabase creates a temporary directory for the database files during testing.
 func setupDatabase() error {
@@ -26,15 +35,46 @@ func setupDatabase() error {
 	}
 
 	dataPath = tempDir
-	apiKey = "test-api-key"
+	apiKey = "42-0123456789abcdef0123456789abcdef"
 	os.OpenFile(filepath.Join(tempDir, fmt.Sprintf("%s.db", apiKey)), os.O_RDONLY|os.O_CREATE, 0666)
+	stores = newStoreIndex()
+	// Change feeds outlive stores; start each test without them.
+	feeds.Lock()
+	feeds.stores = make(map[string]*changeFeed)
+	feeds.Unlock()
+	routers = mux.NewRouter()
 	RegisterRoutes(routers)
+	routers.Use(ApiKeyMiddleware)
 	routers.Use(DisableSystemBucketMiddleware)
 	return nil
 }
 
+// do sends a request to routers with the test store's API key.
+func do(method, target, body string) *httptest.ResponseRecorder {
+	return doWithHeaders(method, target, nil, body)
+}
+
+// doAs sends a request to routers authenticated with key.
+func doAs(key, method, target, body string) *httptest.ResponseRecorder {
+	return doWithHeaders(method, target, map[string]string{"API-KEY": key}, body)
+}
+
+// doWithHeaders sends a request to routers with the test store's API key
+// and the given headers, which may replace it.
+func doWithHeaders(method, target string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	req.Header.Set("API-KEY", apiKey)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+	return w
+}
+
 // teardownDatabase removes the temporary directory after testing.
 func teardownDatabase() {
+	pool.closeAll()
 	os.RemoveAll(tempDir)
 }
 
@@ -149,6 +189,1698 @@ func TestE2E(t *testing.T) {
 
 }
 
+func TestInvalidApiKeys(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	outside := filepath.Join(filepath.Dir(tempDir), "outside.db")
+	os.OpenFile(outside, os.O_RDONLY|os.O_CREATE, 0666)
+	defer os.Remove(outside)
+
+	for _, key := range []string{
+		"../outside",
+		"test-api-key",
+		"42-0123456789ABCDEF0123456789ABCDEF",
+		"42-ffffffffffffffffffffffffffffffff",
+		"43-0123456789abcdef0123456789abcdef",
+	} {
+		req := httptest.NewRequest("POST", "/buckets", nil)
+		req.Header.Set("API-KEY", key)
+		w := httptest.NewRecorder()
+		routers.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for key %q, got %d: %v", key, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestArbitraryJsonValues(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	req := httptest.NewRequest("PUT", "/testbucket", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w := httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	for _, value := range []string{`42`, `"hello"`, `[1,2,3]`, `null`, `true`, `{"b":1,"a":2}`} {
+		req = httptest.NewRequest("PUT", "/testbucket/testkey", bytes.NewReader([]byte(value)))
+		req.Header.Set("API-KEY", apiKey)
+		w = httptest.NewRecorder()
+		routers.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to set %s: %v", value, w.Body.String())
+		}
+
+		req = httptest.NewRequest("GET", "/testbucket/testkey", nil)
+		req.Header.Set("API-KEY", apiKey)
+		w = httptest.NewRecorder()
+		routers.ServeHTTP(w, req)
+
+		if w.Body.String() != value {
+			t.Fatalf("Expected %s, but got %s", value, w.Body.String())
+		}
+	}
+
+	req = httptest.NewRequest("PUT", "/testbucket/testkey", bytes.NewReader([]byte(`{"a":`)))
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid JSON, got %d", w.Code)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	req := httptest.NewRequest("PUT", "/testbucket", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w := httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	png := []byte{0x89, 'P', 'N', 'G', 0x00, 0x01, 0x02}
+	req = httptest.NewRequest("PUT", "/testbucket/image", bytes.NewReader(png))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("Content-Type", "image/png")
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set binary value: %v", w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+
+	req = httptest.NewRequest("GET", "/testbucket/image", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if !bytes.Equal(w.Body.Bytes(), png) {
+		t.Fatalf("Expected %v, but got %v", png, w.Body.Bytes())
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected image/png, but got %v", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Length") != fmt.Sprint(len(png)) {
+		t.Fatalf("Expected Content-Length %d, but got %v", len(png), w.Header().Get("Content-Length"))
+	}
+	if etag == "" || w.Header().Get("ETag") != etag {
+		t.Fatalf("Expected ETag %v, but got %v", etag, w.Header().Get("ETag"))
+	}
+}
+
+func TestKeyTTL(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	req := httptest.NewRequest("PUT", "/testbucket", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w := httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	req = httptest.NewRequest("PUT", "/testbucket/session?ttl=50ms", bytes.NewReader([]byte(`"token"`)))
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set key with TTL: %v", w.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/testbucket/forever", bytes.NewReader([]byte(`"token"`)))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("X-TTL", "3600")
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	req = httptest.NewRequest("GET", "/testbucket/session", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != `"token"` {
+		t.Fatalf("Expected key before expiry, got %d: %v", w.Code, w.Body.String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/testbucket/session", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after expiry, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/testbucket", nil)
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	var keysResponse map[string][]string
+	json.NewDecoder(w.Body).Decode(&keysResponse)
+	if len(keysResponse["keys"]) != 1 || keysResponse["keys"][0] != "forever" {
+		t.Fatalf("Expected only 'forever', but got %v", keysResponse["keys"])
+	}
+
+	store := filepath.Join(tempDir, apiKey+".db")
+	deleted, err := sweepStore(store)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected sweeper to delete 1 key, deleted %d: %v", deleted, err)
+	}
+
+	// Only stores with keys due are swept again, and keys keep their
+	// expiry when their bucket is renamed.
+	if expiries.pending(poolKey(store), time.Now()) {
+		t.Fatalf("Expected no keys due after the sweep")
+	}
+	req = httptest.NewRequest("PUT", "/testbucket/short?ttl=50ms", bytes.NewReader([]byte(`1`)))
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("POST", "/testbucket/_rename", strings.NewReader(`{"to": "moved"}`))
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	time.Sleep(60 * time.Millisecond)
+	if !expiries.pending(poolKey(store), time.Now()) {
+		t.Fatalf("Expected a key due after writing one with a TTL")
+	}
+	if deleted, err := sweepStore(store); err != nil || deleted != 1 {
+		t.Fatalf("Expected sweeper to delete the renamed key, deleted %d: %v", deleted, err)
+	}
+
+	// Keys written before the expiry index existed are indexed once.
+	req = httptest.NewRequest("PUT", "/moved/old?ttl=50ms", bytes.NewReader([]byte(`1`)))
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	db, release, err := pool.acquire(store)
+	if err != nil {
+		t.Fatalf("Could not open the store: %v", err)
+	}
+	db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(reservedBucket)).DeleteBucket([]byte(expiryBucket))
+	})
+	release()
+	time.Sleep(60 * time.Millisecond)
+	if deleted, err := sweepStore(store); err != nil || deleted != 1 {
+		t.Fatalf("Expected sweeper to delete the unindexed key, deleted %d: %v", deleted, err)
+	}
+
+	req = httptest.NewRequest("PUT", "/testbucket/bad?ttl=-5", bytes.NewReader([]byte(`1`)))
+	req.Header.Set("API-KEY", apiKey)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a negative TTL, got %d", w.Code)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/testbucket", "")
+
+	w := doWithHeaders("PUT", "/testbucket/counter", map[string]string{"If-None-Match": "*"}, `1`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to create key: %v", w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+
+	w = doWithHeaders("PUT", "/testbucket/counter", map[string]string{"If-None-Match": "*"}, `2`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 when creating an existing key, got %d", w.Code)
+	}
+
+	w = doWithHeaders("PUT", "/testbucket/counter", map[string]string{"If-Match": etag}, `2`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to update with matching ETag: %v", w.Body.String())
+	}
+	newEtag := w.Header().Get("ETag")
+
+	w = doWithHeaders("PUT", "/testbucket/counter", map[string]string{"If-Match": etag}, `3`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for a stale ETag, got %d", w.Code)
+	}
+
+	w = doWithHeaders("GET", "/testbucket/counter", map[string]string{"If-None-Match": newEtag}, "")
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 for a current ETag, got %d", w.Code)
+	}
+
+	w = doWithHeaders("GET", "/testbucket/counter", map[string]string{"If-Match": `"nope"`, "If-None-Match": "*"}, "")
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected If-Match to be evaluated first, got %d", w.Code)
+	}
+
+	w = doWithHeaders("DELETE", "/testbucket/counter", map[string]string{"If-Match": etag}, "")
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 when deleting with a stale ETag, got %d", w.Code)
+	}
+
+	w = doWithHeaders("DELETE", "/testbucket/counter", map[string]string{"If-Match": newEtag}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to delete with matching ETag: %v", w.Body.String())
+	}
+
+	w = doWithHeaders("DELETE", "/testbucket/counter", map[string]string{"If-Match": "*"}, "")
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 when deleting a missing key with If-Match, got %d", w.Code)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/accounts", "")
+	do("PUT", "/accounts/alice", `100`)
+	do("PUT", "/accounts/bob", `0`)
+
+	w := do("POST", "/_txn", `{"ops": [
+		{"op": "check", "bucket": "accounts", "key": "alice", "equals": 100},
+		{"op": "put", "bucket": "accounts", "key": "alice", "value": 70},
+		{"op": "put", "bucket": "accounts", "key": "bob", "value": 30}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Transaction failed: %v", w.Body.String())
+	}
+
+	w = do("POST", "/_txn", `{"ops": [
+		{"op": "put", "bucket": "accounts", "key": "carol", "value": 1},
+		{"op": "delete", "bucket": "accounts", "key": "bob"},
+		{"op": "check", "bucket": "accounts", "key": "alice", "equals": 100}
+	]}`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for a failed check, got %d: %v", w.Code, w.Body.String())
+	}
+
+	for key, expected := range map[string]string{"alice": "70", "bob": "30"} {
+		w = do("GET", "/accounts/"+key, "")
+		if w.Body.String() != expected {
+			t.Fatalf("Expected %s=%s, but got %v", key, expected, w.Body.String())
+		}
+	}
+	if w = do("GET", "/accounts/carol", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Aborted transaction left a partial write")
+	}
+
+	w = do("POST", "/_txn", `{"ops": [{"op": "put", "bucket": "`+reservedBucket+`", "key": "k", "value": 1}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for the system bucket, got %d", w.Code)
+	}
+}
+
+func TestBatchOperations(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/testbucket", "")
+
+	w := do("POST", "/testbucket/_mput", `{"items": [{"key": "a", "value": 1}, {"key": "b", "value": {"x": true}}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Batch put failed: %v", w.Body.String())
+	}
+
+	w = do("POST", "/testbucket/_mget", `{"keys": ["a", "missing", "b"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Batch get failed: %v", w.Body.String())
+	}
+	var getResponse struct {
+		Items []batchItem `json:"items"`
+	}
+	json.NewDecoder(w.Body).Decode(&getResponse)
+	if len(getResponse.Items) != 3 ||
+		string(getResponse.Items[0].Value) != `1` ||
+		getResponse.Items[1].Found ||
+		string(getResponse.Items[2].Value) != `{"x":true}` {
+		t.Fatalf("Unexpected batch get response: %+v", getResponse.Items)
+	}
+
+	w = do("POST", "/testbucket/_mdelete", `{"keys": ["a", "missing"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Batch delete failed: %v", w.Body.String())
+	}
+	if w = do("GET", "/testbucket/a", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 'a' to be deleted, got %d", w.Code)
+	}
+
+	if w = do("POST", "/nobucket/_mget", `{"keys": ["a"]}`); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing bucket, got %d", w.Code)
+	}
+}
+
+func TestPaginatedListing(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/testbucket", "")
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		do("PUT", "/testbucket/"+key, `1`)
+	}
+
+	list := func(query string) keyListResponse {
+		w := do("GET", "/testbucket?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to list %q: %v", query, w.Body.String())
+		}
+		var response keyListResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		return response
+	}
+
+	for query, expected := range map[string]string{
+		"":                          "a1 a2 a3 b1 b2 c1",
+		"prefix=a":                  "a1 a2 a3",
+		"prefix=b&reverse=true":     "b2 b1",
+		"start=a2&end=b2":           "a2 a3 b1",
+		"start=a2&end=b2&reverse=1": "b1 a3 a2",
+		"after=a3":                  "b1 b2 c1",
+		"after=b1&reverse=true":     "a3 a2 a1",
+		"prefix=z":                  "",
+	} {
+		response := list(query)
+		if got := strings.Join(response.Keys, " "); got != expected || response.Next != "" {
+			t.Fatalf("Listing %q: expected %q, but got %q (next %q)", query, expected, got, response.Next)
+		}
+	}
+
+	var pages []string
+	query := "limit=4"
+	for {
+		response := list(query)
+		pages = append(pages, strings.Join(response.Keys, " "))
+		if response.Next == "" {
+			break
+		}
+		query = "limit=4&after=" + response.Next
+	}
+	if strings.Join(pages, "|") != "a1 a2 a3 b1|b2 c1" {
+		t.Fatalf("Unexpected pages: %q", pages)
+	}
+
+	if w := do("GET", "/testbucket?limit=0", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for limit=0, got %d", w.Code)
+	}
+}
+
+func TestScan(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/testbucket", "")
+	do("PUT", "/testbucket/a", `{"n":1}`)
+	do("PUT", "/testbucket/b", `"two"`)
+	do("PUT", "/testbucket/c", `3`)
+
+	w := do("GET", "/testbucket/_scan?limit=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Scan failed: %v", w.Body.String())
+	}
+	var response struct {
+		Items []scanItem `json:"items"`
+		Next  string     `json:"next"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Scan returned invalid JSON: %v", err)
+	}
+	if len(response.Items) != 2 || response.Items[0].Key != "a" || string(response.Items[0].Value) != `{"n":1}` ||
+		response.Items[1].Key != "b" || string(response.Items[1].Value) != `"two"` || response.Next != "b" {
+		t.Fatalf("Unexpected scan response: %+v", response)
+	}
+
+	w = do("GET", "/testbucket/_scan?format=ndjson&after=a", "")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Header().Get("Content-Type") != "application/x-ndjson" || len(lines) != 2 {
+		t.Fatalf("Unexpected NDJSON scan response: %v", w.Body.String())
+	}
+	var item scanItem
+	json.Unmarshal([]byte(lines[1]), &item)
+	if item.Key != "c" || string(item.Value) != `3` {
+		t.Fatalf("Unexpected NDJSON item: %v", lines[1])
+	}
+
+	// Without a limit a scan returns at most scanPageSize pairs.
+	defer func(size int) { scanPageSize = size }(scanPageSize)
+	scanPageSize = 2
+	response.Next = ""
+	json.NewDecoder(do("GET", "/testbucket/_scan?limit=5", "").Body).Decode(&response)
+	if len(response.Items) != 2 || response.Next != "b" {
+		t.Fatalf("Expected a page of 2 pairs, got %+v", response)
+	}
+}
+
+func TestNestedBuckets(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	if w := do("PUT", "/app/users/eu/", ""); w.Code != http.StatusOK {
+		t.Fatalf("Failed to create nested bucket: %v", w.Body.String())
+	}
+	do("PUT", "/app/users/us/", "")
+	do("PUT", "/app/config", `{"debug":false}`)
+
+	if w := do("PUT", "/app/users/eu/123", `{"name":"Anna"}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to set key in nested bucket: %v", w.Body.String())
+	}
+	if w := do("GET", "/app/users/eu/123", ""); w.Body.String() != `{"name":"Anna"}` {
+		t.Fatalf("Expected nested value, but got %v", w.Body.String())
+	}
+
+	w := do("GET", "/app/", "")
+	var response keyListResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if strings.Join(response.Keys, ",") != "config" || strings.Join(response.Buckets, ",") != "users" {
+		t.Fatalf("Expected key 'config' and bucket 'users', but got %+v", response)
+	}
+
+	w = do("GET", "/app/users/", "")
+	response = keyListResponse{}
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Keys) != 0 || strings.Join(response.Buckets, ",") != "eu,us" {
+		t.Fatalf("Expected buckets 'eu,us', but got %+v", response)
+	}
+
+	if w = do("PUT", "/app/config/", ""); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 creating a bucket over a key, got %d", w.Code)
+	}
+
+	if w = do("DELETE", "/app/users/eu/", ""); w.Code != http.StatusOK {
+		t.Fatalf("Failed to delete nested bucket: %v", w.Body.String())
+	}
+	if w = do("GET", "/app/users/eu/123", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after deleting nested bucket, got %d", w.Code)
+	}
+
+	if w = do("PUT", "/"+reservedBucket+"/nested/", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("System bucket allowed nested create: %v", w.Body.String())
+	}
+
+	// Names starting with '_' would be shadowed by endpoints.
+	for _, target := range []string{"/app/_stats", "/app/_private/", "/_keys", "/app/users/_scan/"} {
+		if w = do("PUT", target, `1`); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for reserved name %s, got %d", target, w.Code)
+		}
+	}
+	if w = do("POST", "/_txn", `{"ops":[{"op":"put","bucket":"app","key":"_schema","value":1}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a reserved key in a transaction, got %d", w.Code)
+	}
+	if w = do("POST", "/app/users/_rename", `{"to":"_users"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 renaming to a reserved name, got %d", w.Code)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/counters", "")
+
+	if w := do("POST", "/counters/visits/_incr", ""); w.Body.String() != "{\"value\":1}\n" {
+		t.Fatalf("Expected a new counter at 1, but got %d: %v", w.Code, w.Body.String())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do("POST", "/counters/visits/_incr", `{"delta": 2}`)
+		}()
+	}
+	wg.Wait()
+	if w := do("GET", "/counters/visits", ""); w.Body.String() != "41" {
+		t.Fatalf("Expected 41 after concurrent increments, but got %v", w.Body.String())
+	}
+
+	if w := do("POST", "/counters/visits/_incr", `{"delta": -100, "min": 0}`); w.Body.String() != "{\"value\":0}\n" {
+		t.Fatalf("Expected counter clamped to 0, but got %v", w.Body.String())
+	}
+
+	do("PUT", "/counters/user", `{"name": "Anna", "stats": {"logins": 1.5}}`)
+	if w := do("POST", "/counters/user/_incr", `{"field": "/stats/logins", "delta": 1}`); w.Body.String() != "{\"value\":2.5}\n" {
+		t.Fatalf("Expected field counter 2.5, but got %v", w.Body.String())
+	}
+	if w := do("GET", "/counters/user", ""); !jsonEqual(w.Body.Bytes(), []byte(`{"name": "Anna", "stats": {"logins": 2.5}}`)) {
+		t.Fatalf("Unexpected object after field increment: %v", w.Body.String())
+	}
+
+	if w := do("POST", "/counters/user/_incr", `{"field": "/name"}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 incrementing a string, got %d", w.Code)
+	}
+
+	do("PUT", "/counters/html", `{"z":1,"a":"<b>","n":0}`)
+	do("POST", "/counters/html/_incr", `{"field": "/n"}`)
+	if w := do("GET", "/counters/html", ""); w.Body.String() != `{"a":"<b>","n":1,"z":1}` {
+		t.Fatalf("Expected strings kept unescaped, but got %v", w.Body.String())
+	}
+}
+
+func TestPatch(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	doWithHeaders("PUT", "/users/1", map[string]string{"Content-Type": "application/json"}, `{"name": "Anna", "tags": ["a"], "address": {"city": "Riga", "zip": "1000"}}`)
+
+	w := doWithHeaders("PATCH", "/users/1", map[string]string{"Content-Type": mergePatchType}, `{"address": {"zip": null, "country": "LV"}, "age": 30}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Merge patch failed: %v", w.Body.String())
+	}
+	expected := `{"name": "Anna", "tags": ["a"], "address": {"city": "Riga", "country": "LV"}, "age": 30}`
+	if !jsonEqual(w.Body.Bytes(), []byte(expected)) {
+		t.Fatalf("Expected %s, but got %s", expected, w.Body.String())
+	}
+
+	w = doWithHeaders("PATCH", "/users/1", map[string]string{"Content-Type": jsonPatchType}, `[
+		{"op": "test", "path": "/name", "value": "Anna"},
+		{"op": "add", "path": "/tags/-", "value": "b"},
+		{"op": "replace", "path": "/age", "value": 31},
+		{"op": "move", "from": "/address/city", "path": "/city"},
+		{"op": "copy", "from": "/tags", "path": "/labels"},
+		{"op": "remove", "path": "/address"}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("JSON patch failed: %v", w.Body.String())
+	}
+	expected = `{"name": "Anna", "tags": ["a", "b"], "labels": ["a", "b"], "age": 31, "city": "Riga"}`
+	if !jsonEqual(w.Body.Bytes(), []byte(expected)) {
+		t.Fatalf("Expected %s, but got %s", expected, w.Body.String())
+	}
+
+	w = doWithHeaders("PATCH", "/users/1", map[string]string{"Content-Type": jsonPatchType}, `[
+		{"op": "replace", "path": "/age", "value": 99},
+		{"op": "test", "path": "/name", "value": "Bob"}
+	]`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a failed test, got %d: %v", w.Code, w.Body.String())
+	}
+
+	w = doWithHeaders("PATCH", "/users/1", map[string]string{"Content-Type": jsonPatchType}, `[{"op": "remove", "path": "/missing"}]`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for a missing path, got %d: %v", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/users/1", "")
+	if !jsonEqual(w.Body.Bytes(), []byte(expected)) {
+		t.Fatalf("Failed patches modified the value: %s", w.Body.String())
+	}
+
+	if w = doWithHeaders("PATCH", "/users/1", map[string]string{"Content-Type": "application/json"}, `{}`); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected 415 for plain JSON, got %d", w.Code)
+	}
+	if w = doWithHeaders("PATCH", "/users/2", map[string]string{"Content-Type": mergePatchType}, `{}`); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing key, got %d", w.Code)
+	}
+
+	doWithHeaders("PUT", "/users/3", map[string]string{"Content-Type": "application/json"}, `{"id": 9007199254740993, "bio": "<b>"}`)
+	w = doWithHeaders("PATCH", "/users/3", map[string]string{"Content-Type": jsonPatchType}, `[{"op": "test", "path": "/id", "value": 9007199254740992}]`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a number beyond float64 precision, got %d", w.Code)
+	}
+	w = doWithHeaders("PATCH", "/users/3", map[string]string{"Content-Type": jsonPatchType}, `[{"op": "test", "path": "/id", "value": 9007199254740993.0}]`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"bio":"<b>","id":9007199254740993}` {
+		t.Fatalf("Expected the value unchanged and unescaped, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetSubtree(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/1", `{"profile": {"email": "anna@example.com", "a/b": [10, 20], "note": "x<y&z", "z": {"b": 1, "a": 2}}}`)
+
+	for query, expected := range map[string]string{
+		"/profile/email":  `"anna@example.com"`,
+		"/profile/a~1b":   `[10, 20]`,
+		"/profile/a~1b/1": `20`,
+		"/profile/note":   `"x<y&z"`,
+		"/profile/z":      `{"b": 1, "a": 2}`,
+	} {
+		w := do("GET", "/users/1?path="+url.QueryEscape(query), "")
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatalf("Path %s: expected %s, but got %d: %v", query, expected, w.Code, w.Body.String())
+		}
+	}
+
+	if w := do("GET", "/users/1?path=/profile/phone", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing path, got %d", w.Code)
+	}
+	if w := do("GET", "/users/1?path=profile", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid pointer, got %d", w.Code)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/1", `{"name": "anna", "age": 31, "status": "active"}`)
+	do("PUT", "/users/2", `{"name": "bob", "age": 17, "status": "active"}`)
+	do("PUT", "/users/3", `{"name": "carl", "age": 45, "status": "banned", "email": "c@example.com"}`)
+	do("PUT", "/users/4", `{"name": "dora", "age": 22.5, "status": "trial"}`)
+	do("PUT", "/users/5", `"not an object"`)
+
+	query := func(body string) []scanItem {
+		w := do("POST", "/users/_query", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Query %s failed with %d: %v", body, w.Code, w.Body.String())
+		}
+		var response struct {
+			Items []scanItem `json:"items"`
+			Count int        `json:"count"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Query returned invalid JSON: %v", err)
+		}
+		if response.Count != len(response.Items) {
+			t.Fatalf("Count %d does not match %d items", response.Count, len(response.Items))
+		}
+		return response.Items
+	}
+	keys := func(items []scanItem) string {
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	for body, expected := range map[string]string{
+		`{"filter": {"field": "/age", "gte": 18}}`:                                                 "1,3,4",
+		`{"filter": {"field": "/status", "in": ["active", "trial"]}}`:                              "1,2,4",
+		`{"filter": {"field": "/email", "exists": true}}`:                                          "3",
+		`{"filter": {"and": [{"field": "/age", "gt": 18}, {"field": "/status", "eq": "active"}]}}`: "1",
+		`{"filter": {"or": [{"field": "/age", "lt": 18}, {"field": "/name", "eq": "carl"}]}}`:      "2,3",
+		`{"filter": {"not": {"field": "/status", "ne": "active"}}}`:                                "1,2",
+		`{"filter": {"field": "/age", "gte": 18}, "sort": [{"field": "/age", "desc": true}]}`:      "3,1,4",
+		`{"sort": [{"field": "/name"}], "limit": 2}`:                                               "1,2",
+		`{"filter": {"field": "/status", "eq": "active"}, "limit": 1}`:                             "1",
+		`{"filter": {"field": "/age", "gte": "18"}}`:                                               "",
+	} {
+		if got := keys(query(body)); got != expected {
+			t.Fatalf("Query %s: expected %q, but got %q", body, expected, got)
+		}
+	}
+
+	do("PUT", "/users/6", `{"name": "<eve>", "status": "x"}`)
+	if w := do("POST", "/users/_query", `{"filter": {"field": "/status", "eq": "x"}}`); !strings.Contains(w.Body.String(), `{"name":"<eve>","status":"x"}`) {
+		t.Fatalf("Expected the stored value unchanged, but got %v", w.Body.String())
+	}
+	do("DELETE", "/users/6", "")
+
+	items := query(`{"filter": {"field": "/name", "eq": "anna"}, "fields": ["/name", "/age"]}`)
+	if len(items) != 1 || string(items[0].Value) != `{"age":31,"name":"anna"}` || items[0].ETag == "" {
+		t.Fatalf("Unexpected projection: %+v", items)
+	}
+
+	for _, body := range []string{
+		`{"filter": {"field": "/age"}}`,
+		`{"filter": {"field": "/age", "eq": 1, "gt": 0}}`,
+		`{"filter": {"field": "age", "eq": 1}}`,
+		`{"filter": {"eq": 1}}`,
+		`{"filter": {"and": []}}`,
+		`{"filter": {"or": []}}`,
+	} {
+		if w := do("POST", "/users/_query", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	if w := do("POST", "/missing/_query", `{}`); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing bucket, got %d", w.Code)
+	}
+
+	// Numbers compare exactly, beyond float64 precision.
+	do("PUT", "/ids", "")
+	do("PUT", "/ids/a", `{"id": 9007199254740993}`)
+	for filter, expected := range map[string]int{
+		`{"field": "/id", "eq": 9007199254740992}`: 0,
+		`{"field": "/id", "eq": 9007199254740993}`: 1,
+		`{"field": "/id", "gt": 9007199254740992}`: 1,
+	} {
+		w := do("POST", "/ids/_query", `{"filter": `+filter+`}`)
+		var response struct {
+			Count int `json:"count"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		if response.Count != expected {
+			t.Fatalf("Query %s: expected %d items, but got %d", filter, expected, response.Count)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/1", `{"name": "anna", "score": -5}`)
+	do("PUT", "/users/2", `{"name": "bob", "score": 2.5}`)
+	do("PUT", "/users/3", `{"name": "carl", "score": 100}`)
+	do("PUT", "/users/4", `{"name": "dora", "score": "high"}`)
+
+	w := do("POST", "/users/_indexes", `{"field": "/score"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"entries":4`) {
+		t.Fatalf("Creating an index failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/users/_indexes", `{"field": "score"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid field, got %d", w.Code)
+	}
+
+	// Writes through every endpoint keep the index up to date.
+	do("PUT", "/users/5", `{"name": "emil", "score": 10}`)
+	do("DELETE", "/users/1", "")
+	req := httptest.NewRequest("PATCH", "/users/4", strings.NewReader(`{"score": 0}`))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("Content-Type", mergePatchType)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	do("POST", "/users/6/_incr", `{"delta": 7, "field": "/score"}`)
+	do("POST", "/_txn", `{"ops": [{"op": "put", "bucket": "users", "key": "7", "value": {"score": 1}}]}`)
+
+	query := func(filter string) string {
+		w := do("POST", "/users/_query", `{"filter": `+filter+`}`)
+		var response struct {
+			Items []scanItem `json:"items"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		var keys []string
+		for _, item := range response.Items {
+			keys = append(keys, item.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+	for filter, expected := range map[string]string{
+		`{"field": "/score", "gt": 1}`:                                              "2,3,5,6",
+		`{"field": "/score", "lte": 2.5}`:                                           "2,4,7",
+		`{"field": "/score", "eq": 100}`:                                            "3",
+		`{"field": "/score", "in": [0, 7, "high"]}`:                                 "4,6",
+		`{"and": [{"field": "/score", "gte": 0}, {"field": "/name", "eq": "bob"}]}`: "2",
+	} {
+		if got := query(filter); got != expected {
+			t.Fatalf("Query %s: expected %q, but got %q", filter, expected, got)
+		}
+	}
+
+	w = do("GET", "/users/_indexes", "")
+	if !strings.Contains(w.Body.String(), `{"field":"/score","entries":6}`) {
+		t.Fatalf("Unexpected index list: %v", w.Body.String())
+	}
+	if w := do("POST", "/users/_indexes/_rebuild", ""); !strings.Contains(w.Body.String(), `"entries":6`) {
+		t.Fatalf("Unexpected rebuild response: %v", w.Body.String())
+	}
+
+	// Deleting the bucket drops its indexes.
+	do("DELETE", "/users", "")
+	do("PUT", "/users", "")
+	if w := do("GET", "/users/_indexes", ""); w.Body.String() != "{\"indexes\":[]}\n" {
+		t.Fatalf("Expected no indexes after recreating the bucket, got %v", w.Body.String())
+	}
+	if w := do("DELETE", "/users/_indexes?field=/score", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing index, got %d", w.Code)
+	}
+}
+
+func TestUniqueIndexes(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/1", `{"email": "anna@example.com"}`)
+	do("PUT", "/users/2", `{"email": "anna@example.com"}`)
+
+	if w := do("POST", "/users/_indexes", `{"field": "/email", "unique": true}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 when stored values collide, got %d: %v", w.Code, w.Body.String())
+	}
+	do("PUT", "/users/2", `{"email": "bob@example.com"}`)
+	if w := do("POST", "/users/_indexes", `{"field": "/email", "unique": true}`); w.Code != http.StatusOK {
+		t.Fatalf("Creating a unique index failed with %d: %v", w.Code, w.Body.String())
+	}
+
+	w := do("PUT", "/users/3", `{"email": "anna@example.com"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "key 1") {
+		t.Fatalf("Expected 409 for a duplicate email, got %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/3", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Rejected value was stored")
+	}
+	if w := do("PUT", "/users/1", `{"email": "anna@example.com", "name": "Anna"}`); w.Code != http.StatusOK {
+		t.Fatalf("Rewriting a key with its own email failed with %d", w.Code)
+	}
+	w = do("POST", "/_txn", `{"ops": [{"op": "put", "bucket": "users", "key": "4", "value": {"email": "bob@example.com"}}]}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a duplicate email in a transaction, got %d", w.Code)
+	}
+
+	// Freeing a value makes it available again.
+	do("DELETE", "/users/1", "")
+	if w := do("PUT", "/users/3", `{"email": "anna@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the freed email to be accepted, got %d: %v", w.Code, w.Body.String())
+	}
+
+	// So does an expired key, before it is swept.
+	req := httptest.NewRequest("PUT", "/users/5", strings.NewReader(`{"email": "eve@example.com"}`))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("X-TTL", "50ms")
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	time.Sleep(100 * time.Millisecond)
+	if w := do("PUT", "/users/6", `{"email": "eve@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the email of an expired key to be accepted, got %d: %v", w.Code, w.Body.String())
+	}
+
+	// Numbers beyond float64 precision are told apart.
+	do("POST", "/users/_indexes", `{"field": "/id", "unique": true}`)
+	do("PUT", "/users/7", `{"id": 9007199254740993}`)
+	if w := do("PUT", "/users/8", `{"id": 9007199254740992}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected a distinct large number to be accepted, got %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/users/9", `{"id": 9007199254740993}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a duplicate large number, got %d", w.Code)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	schema := `{
+		"type": "object",
+		"required": ["email"],
+		"properties": {
+			"email": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/1", `{"email": "anna@example.com", "age": 31}`)
+	do("PUT", "/users/2", `{"age": -1}`)
+
+	w := do("POST", "/users/_schema/_validate", schema)
+	var report struct {
+		Valid   bool `json:"valid"`
+		Checked int  `json:"checked"`
+		Invalid []struct {
+			Key        string            `json:"key"`
+			Violations []schemaViolation `json:"violations"`
+		} `json:"invalid"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Validation returned invalid JSON: %v", err)
+	}
+	if report.Valid || report.Checked != 2 || len(report.Invalid) != 1 || report.Invalid[0].Key != "2" ||
+		len(report.Invalid[0].Violations) != 2 {
+		t.Fatalf("Unexpected validation report: %+v", report)
+	}
+
+	if w := do("PUT", "/users/_schema", `{"type": "nope"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid schema, got %d", w.Code)
+	}
+	if w := do("PUT", "/users/_schema", `{"$ref": "file:///etc/passwd"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a schema referencing a file, got %d", w.Code)
+	}
+	if w := do("PUT", "/users/_schema", schema); w.Code != http.StatusOK {
+		t.Fatalf("Setting the schema failed with %d: %v", w.Code, w.Body.String())
+	}
+
+	w = do("PUT", "/users/3", `{"email": 42}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "/email") {
+		t.Fatalf("Expected 422 listing /email, got %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/users/3", `{"email": "carl@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("Valid value was rejected with %d: %v", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("PATCH", "/users/3", strings.NewReader(`{"age": "old"}`))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("Content-Type", mergePatchType)
+	w = httptest.NewRecorder()
+	routers.ServeHTTP(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for an invalid patch result, got %d", w.Code)
+	}
+	if w := do("POST", "/users/_mput", `{"items": [{"key": "4", "value": {}}]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for an invalid batch item, got %d", w.Code)
+	}
+
+	if w := do("GET", "/users/_schema", ""); w.Code != http.StatusOK || w.Body.String() != schema {
+		t.Fatalf("Unexpected schema: %d %v", w.Code, w.Body.String())
+	}
+	do("DELETE", "/users/_schema", "")
+	if w := do("PUT", "/users/3", `{"email": 42}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected writes to be accepted without a schema, got %d", w.Code)
+	}
+}
+
+func TestStats(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	before := time.Now().Add(-time.Second)
+	do("PUT", "/app/users/", "")
+	do("PUT", "/app/a", `"one"`)
+	do("PUT", "/app/b", `[1, 2]`)
+	do("PUT", "/app/c?ttl=1ms", `3`)
+	do("PUT", "/app/d?ttl=3600", `4`)
+	time.Sleep(5 * time.Millisecond)
+
+	var stats bucketStats
+	w := do("GET", "/app/_stats", "")
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Stats returned invalid JSON: %v", err)
+	}
+	if stats.Keys != 3 || stats.Buckets != 1 || stats.ValueBytes != int64(len(`"one"`)+len(`[1, 2]`)+len(`4`)) {
+		t.Fatalf("Unexpected bucket stats: %+v", stats)
+	}
+	if stats.Created == nil || stats.Created.Before(before) || stats.Modified == nil || stats.Modified.Before(*stats.Created) {
+		t.Fatalf("Unexpected bucket times: %+v", stats)
+	}
+	if stats.Pages.LeafPages == 0 && stats.Pages.InlineBuckets == 0 {
+		t.Fatalf("Expected page statistics, got %+v", stats.Pages)
+	}
+	if w := do("GET", "/missing/_stats", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing bucket, got %d", w.Code)
+	}
+
+	var store storeStats
+	w = do("GET", "/_stats", "")
+	if err := json.NewDecoder(w.Body).Decode(&store); err != nil {
+		t.Fatalf("Store stats returned invalid JSON: %v", err)
+	}
+	if store.FileSize == 0 || store.PageSize == 0 || store.Buckets != 2 {
+		t.Fatalf("Unexpected store stats: %+v", store)
+	}
+}
+
+func TestRenameAndCopyBuckets(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users/eu/", "")
+	do("PUT", "/users/user-1", `{"email": "a@example.com"}`)
+	do("PUT", "/users/user-2", `{"email": "b@example.com"}`)
+	do("PUT", "/users/admin", `{"email": "root@example.com"}`)
+	do("PUT", "/users/eu/user-3", `{"email": "c@example.com"}`)
+	do("POST", "/users/_indexes", `{"field": "/email", "unique": true}`)
+	do("PUT", "/users/_schema", `{"required": ["email"]}`)
+	do("PUT", "/other", "")
+
+	w := do("POST", "/users/_copy", `{"to": "backup"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"keys":4`) {
+		t.Fatalf("Copy failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/backup/eu/user-3", ""); w.Body.String() != `{"email": "c@example.com"}` {
+		t.Fatalf("Nested bucket was not copied: %v", w.Body.String())
+	}
+	if w := do("PUT", "/backup/x", `{"email": "a@example.com"}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected the copied unique index to reject a duplicate, got %d", w.Code)
+	}
+	if w := do("PUT", "/backup/x", `{}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the copied schema to reject a value, got %d", w.Code)
+	}
+
+	if w := do("POST", "/users/_copy", `{"to": "other"}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for an existing target, got %d", w.Code)
+	}
+	if w := do("POST", "/users/_copy", `{"to": "users/eu"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a target inside the source, got %d", w.Code)
+	}
+	w = do("POST", "/users/_copy", `{"to": "other", "prefix": "user-", "overwrite": true}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"keys":2`) {
+		t.Fatalf("Copy with prefix failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/other/admin", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Key outside the prefix was copied")
+	}
+
+	// Moving keys under a prefix leaves the rest of the bucket in place.
+	if w := do("POST", "/users/_rename", `{"to": "archive/users", "prefix": "user-"}`); w.Code != http.StatusOK {
+		t.Fatalf("Rename with prefix failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/user-1", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Moved key is still in the source bucket")
+	}
+	if w := do("PUT", "/users/user-9", `{"email": "a@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the moved email to be free in the source index, got %d", w.Code)
+	}
+
+	if w := do("POST", "/users/_rename", `{"to": "people"}`); w.Code != http.StatusOK {
+		t.Fatalf("Rename failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Renamed bucket still exists")
+	}
+	if w := do("GET", "/people/_indexes", ""); !strings.Contains(w.Body.String(), `"entries":2`) {
+		t.Fatalf("Index did not follow the rename: %v", w.Body.String())
+	}
+	do("PUT", "/users", "")
+	if w := do("GET", "/users/_schema", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Schema stayed behind after the rename")
+	}
+}
+
+func TestScopedTokens(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	newToken := func(body string) (string, string) {
+		w := do("POST", "/_tokens", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Creating a token failed with %d: %v", w.Code, w.Body.String())
+		}
+		var resp struct{ Token, ID string }
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Token, resp.ID
+	}
+
+	do("PUT", "/users", "")
+	do("PUT", "/orders", "")
+	do("PUT", "/users/alice", `{"name": "Alice"}`)
+
+	reader, _ := newToken(`{"name": "dashboard", "scope": "read"}`)
+	if w := doAs(reader, "GET", "/users/alice", ""); w.Code != http.StatusOK {
+		t.Fatalf("Read token could not read, got %d", w.Code)
+	}
+
+	// Tokens of a known store do not rescan the data directory.
+	defer func(interval time.Duration) { storeRescanInterval = interval }(storeRescanInterval)
+	storeRescanInterval = 0
+	scanned := stores.lastScan
+	if w := doAs(reader, "GET", "/users/alice", ""); w.Code != http.StatusOK || !stores.lastScan.Equal(scanned) {
+		t.Fatalf("Expected the token to be accepted without a rescan, got %d", w.Code)
+	}
+	if w := doAs(reader, "PUT", "/users/bob", `{}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a write with a read token, got %d", w.Code)
+	}
+	if w := doAs(reader, "POST", "/users/_mput", `{"items": [{"key": "bob", "value": {}}]}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a batch write with a read token, got %d", w.Code)
+	}
+	if w := doAs(reader, "POST", "/_txn", `{"ops": [{"op": "delete", "bucket": "users", "key": "alice"}]}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a transaction write with a read token, got %d", w.Code)
+	}
+
+	writer, writerID := newToken(`{"scope": "write", "buckets": ["users"]}`)
+	if w := doAs(writer, "PUT", "/users/bob", `{"name": "Bob"}`); w.Code != http.StatusOK {
+		t.Fatalf("Write token could not write, got %d", w.Code)
+	}
+	if w := doAs(writer, "GET", "/orders/", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 outside the token's buckets, got %d", w.Code)
+	}
+	if w := doAs(writer, "POST", "/users/_copy", `{"to": "orders", "overwrite": true}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a copy outside the token's buckets, got %d", w.Code)
+	}
+	if w := doAs(writer, "GET", "/_stats", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for store statistics with a restricted token, got %d", w.Code)
+	}
+	w := doAs(writer, "POST", "/buckets", "")
+	if !strings.Contains(w.Body.String(), "users") || strings.Contains(w.Body.String(), "orders") {
+		t.Fatalf("Bucket list was not filtered: %v", w.Body.String())
+	}
+	if w := doAs(writer, "POST", "/_tokens", `{"scope": "write"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 when a token creates a token, got %d", w.Code)
+	}
+
+	if w := do("GET", "/_tokens", ""); !strings.Contains(w.Body.String(), "dashboard") || strings.Contains(w.Body.String(), writer) {
+		t.Fatalf("Unexpected token list: %v", w.Body.String())
+	}
+	if w := do("DELETE", "/_tokens/"+writerID, ""); w.Code != http.StatusOK {
+		t.Fatalf("Revoking the token failed with %d", w.Code)
+	}
+	if w := doAs(writer, "GET", "/users/bob", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a revoked token, got %d", w.Code)
+	}
+
+	expiring, _ := newToken(`{"scope": "read", "ttl": "1s"}`)
+	time.Sleep(1100 * time.Millisecond)
+	if w := doAs(expiring, "GET", "/users/alice", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an expired token, got %d", w.Code)
+	}
+}
+
+func TestApiKeyRotation(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	do("PUT", "/users", "")
+	do("PUT", "/users/alice", `{"name": "Alice"}`)
+
+	w := do("POST", "/_keys", `{"name": "ci"}`)
+	var extra struct{ Key, ID string }
+	json.NewDecoder(w.Body).Decode(&extra)
+	if w := doAs(extra.Key, "GET", "/users/alice", ""); w.Code != http.StatusOK {
+		t.Fatalf("Additional key was rejected with %d", w.Code)
+	}
+	if w := doAs(extra.Key, "GET", "/_tokens", ""); w.Code != http.StatusOK {
+		t.Fatalf("Additional key could not manage tokens, got %d", w.Code)
+	}
+
+	w = do("POST", "/_keys/_rotate", `{"grace": "1h"}`)
+	var rotated struct{ Key string }
+	json.NewDecoder(w.Body).Decode(&rotated)
+	if w.Code != http.StatusOK || rotated.Key == "" || rotated.Key == apiKey {
+		t.Fatalf("Rotation failed with %d: %v", w.Code, w.Body.String())
+	}
+	for _, key := range []string{apiKey, rotated.Key, extra.Key} {
+		if w := doAs(key, "GET", "/users/alice", ""); w.Code != http.StatusOK {
+			t.Fatalf("Key %s was rejected after the rotation with %d", key, w.Code)
+		}
+	}
+
+	w = doAs(rotated.Key, "GET", "/_keys", "")
+	if strings.Count(w.Body.String(), `"id"`) != 3 || !strings.Contains(w.Body.String(), `"primary":true`) {
+		t.Fatalf("Unexpected key list: %v", w.Body.String())
+	}
+	if w := doAs(rotated.Key, "DELETE", "/_keys/"+tokenID(rotated.Key), ""); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 when revoking the primary key, got %d", w.Code)
+	}
+	if w := doAs(rotated.Key, "DELETE", "/_keys/"+tokenID(apiKey), ""); w.Code != http.StatusOK {
+		t.Fatalf("Revoking the previous key failed with %d", w.Code)
+	}
+	if w := do("GET", "/users/alice", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for the revoked previous key, got %d", w.Code)
+	}
+
+	// Without a grace period the previous key stops at once.
+	w = doAs(extra.Key, "POST", "/_keys/_rotate", `{"grace": "0"}`)
+	var again struct{ Key string }
+	json.NewDecoder(w.Body).Decode(&again)
+	if w := doAs(rotated.Key, "GET", "/users/alice", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for the replaced key, got %d", w.Code)
+	}
+	if w := doAs(again.Key, "GET", "/users/alice", ""); w.Code != http.StatusOK {
+		t.Fatalf("New key was rejected with %d", w.Code)
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	// Mount the routes like main does, signed URLs first.
+	router := mux.NewRouter()
+	RegisterSignedRoutes(router.PathPrefix("/api").Subrouter())
+	apiRouter := router.PathPrefix("/api").Subrouter()
+	RegisterRoutes(apiRouter)
+	apiRouter.Use(ApiKeyMiddleware)
+	apiRouter.Use(DisableSystemBucketMiddleware)
+
+	send := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+		if key != "" {
+			req.Header.Set("API-KEY", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	sign := func(key, body string) string {
+		w := send("POST", "/api/_sign", key, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Signing failed with %d: %v", w.Code, w.Body.String())
+		}
+		var resp struct{ URL string }
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.URL
+	}
+
+	send("PUT", "/api/app/hooks/", apiKey, "")
+	send("PUT", "/api/app/hooks/last%20event", apiKey, `{"n": 1}`)
+
+	get := sign(apiKey, `{"bucket": "app/hooks", "key": "last event"}`)
+	if w := send("GET", get, "", ""); w.Code != http.StatusOK || w.Body.String() != `{"n": 1}` {
+		t.Fatalf("Signed GET failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := send("HEAD", get, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("Signed HEAD failed with %d", w.Code)
+	}
+	if w := send("PUT", get, "", `{"n": 2}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for another method, got %d", w.Code)
+	}
+	if w := send("GET", strings.Replace(get, "last%20event", "other", 1), "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for another key, got %d", w.Code)
+	}
+	if w := send("GET", strings.Replace(get, "expires=", "expires=9", 1), "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a changed expiry, got %d", w.Code)
+	}
+
+	put := sign(apiKey, `{"bucket": "app/hooks", "key": "incoming", "method": "put", "ttl": "10m"}`)
+	if w := send("PUT", put, "", `{"event": "push"}`); w.Code != http.StatusOK {
+		t.Fatalf("Signed PUT failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := send("GET", "/api/app/hooks/incoming", apiKey, ""); w.Body.String() != `{"event": "push"}` {
+		t.Fatalf("Signed PUT did not store the value: %v", w.Body.String())
+	}
+
+	expiring := sign(apiKey, `{"bucket": "app/hooks", "key": "incoming", "ttl": "1s"}`)
+	if w := send("POST", "/api/_sign", apiKey, `{"bucket": "app/hooks", "key": "x", "ttl": "720h"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a ttl above the maximum, got %d", w.Code)
+	}
+
+	// A read-only token cannot sign writes.
+	w := send("POST", "/api/_tokens", apiKey, `{"scope": "read"}`)
+	var tok struct{ Token, ID string }
+	json.NewDecoder(w.Body).Decode(&tok)
+	if w := send("POST", "/api/_sign", tok.Token, `{"bucket": "app/hooks", "key": "x", "method": "DELETE"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 when a read token signs a write, got %d", w.Code)
+	}
+
+	// A URL signed by a token stops working when the token is revoked.
+	byToken := sign(tok.Token, `{"bucket": "app/hooks", "key": "incoming"}`)
+	if w := send("GET", byToken, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("URL signed by a token failed with %d: %v", w.Code, w.Body.String())
+	}
+	if w := send("GET", strings.Replace(byToken, "token=", "token=0", 1), "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for another token, got %d", w.Code)
+	}
+	send("DELETE", "/api/_tokens/"+tok.ID, apiKey, "")
+	if w := send("GET", byToken, "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 after revoking the signing token, got %d", w.Code)
+	}
+
+	if uri := loggedURI(httptest.NewRequest("GET", get, nil)); strings.Contains(uri, "sig=") {
+		t.Fatalf("Signature was logged: %s", uri)
+	}
+
+	if w := send("DELETE", "/api/_sign", apiKey, ""); w.Code != http.StatusOK {
+		t.Fatalf("Revoking signed URLs failed with %d", w.Code)
+	}
+	if w := send("GET", get, "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 after revoking signed URLs, got %d", w.Code)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if w := send("GET", expiring, "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for an expired URL, got %d", w.Code)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	server := httptest.NewServer(routers)
+	defer server.Close()
+
+	type event struct{ id, name, data string }
+	subscribe := func(target, lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest("GET", server.URL+target, nil)
+		req.Header.Set("API-KEY", apiKey)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Subscribing failed: %v %v", err, resp.Status)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+	next := func(r *bufio.Reader) event {
+		var ev event
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Stream ended: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return ev
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}
+
+	do("PUT", "/users", "")
+	if w := do("GET", "/missing/_changes", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing bucket, got %d", w.Code)
+	}
+
+	stream, stop := subscribe("/users/_changes?prefix=user-", "")
+	do("PUT", "/users/admin", `{"role": "root"}`)
+	do("PUT", "/users/user-1", `{
+		"name": "Alice"
+	}`)
+	do("POST", "/users/user-2/_incr", "")
+	do("DELETE", "/users/user-1", "")
+
+	first := next(stream)
+	if first.name != "put" || !strings.Contains(first.data, `"key":"user-1"`) || !strings.Contains(first.data, `"value":{"name":"Alice"}`) {
+		t.Fatalf("Unexpected first event: %+v", first)
+	}
+	if ev := next(stream); ev.name != "put" || !strings.Contains(ev.data, `"value":1`) {
+		t.Fatalf("Unexpected counter event: %+v", ev)
+	}
+	if ev := next(stream); ev.name != "delete" || !strings.Contains(ev.data, `"key":"user-1"`) {
+		t.Fatalf("Unexpected delete event: %+v", ev)
+	}
+	stop()
+
+	// Resuming replays what came after the last received event.
+	stream, stop = subscribe("/users/_changes?prefix=user-", first.id)
+	if ev := next(stream); ev.name != "put" || !strings.Contains(ev.data, `"key":"user-2"`) {
+		t.Fatalf("Unexpected replayed event: %+v", ev)
+	}
+	if ev := next(stream); ev.name != "delete" {
+		t.Fatalf("Unexpected replayed event: %+v", ev)
+	}
+	stop()
+
+	stream, stop = subscribe("/users/_changes", "1-1")
+	if ev := next(stream); ev.name != "reset" {
+		t.Fatalf("Expected a reset event for an unknown ID, got %+v", ev)
+	}
+	stop()
+
+	// Replacing or deleting a whole bucket resets its subscribers.
+	do("PUT", "/teams", "")
+	stream, stop = subscribe("/teams/_changes?prefix=x", "")
+	do("POST", "/users/_copy", `{"to": "teams", "overwrite": true}`)
+	do("DELETE", "/teams", "")
+	for i := 0; i < 2; i++ {
+		if ev := next(stream); ev.name != "reset" || ev.id == "" || !strings.Contains(ev.data, `"bucket":"teams"`) {
+			t.Fatalf("Expected a reset event for the bucket, got %+v", ev)
+		}
+	}
+	stop()
+
+	// Events of concurrent writes arrive in commit order, so the last one
+	// holds the stored value.
+	stream, stop = subscribe("/users/_changes?prefix=race", "")
+	defer stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			do("PUT", "/users/race", strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+	var last event
+	for i := 0; i < 20; i++ {
+		last = next(stream)
+	}
+	if stored := do("GET", "/users/race", "").Body.String(); !strings.Contains(last.data, `"value":`+stored+",") {
+		t.Fatalf("Last event %s does not hold the stored value %s", last.data, stored)
+	}
+}
+
+func TestChangeFeedRevoked(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+	defer func(heartbeat time.Duration) { changeHeartbeat = heartbeat }(changeHeartbeat)
+	changeHeartbeat = 50 * time.Millisecond
+	server := httptest.NewServer(routers)
+	defer server.Close()
+
+	// A stream opened with a token ends once the token is revoked.
+	do("PUT", "/users", "")
+	var tok struct{ Token string }
+	json.NewDecoder(do("POST", "/_tokens", `{"scope": "read"}`).Body).Decode(&tok)
+	req, _ := http.NewRequest("GET", server.URL+"/users/_changes", nil)
+	req.Header.Set("API-KEY", tok.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribing with a token failed: %v %v", err, resp.Status)
+	}
+	defer resp.Body.Close()
+	do("DELETE", "/_tokens/"+tokenID(tok.Token), "")
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatalf("Stream ended with an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stream was not ended after revoking its token")
+	}
+}
+
+func TestChangeFeedHistory(t *testing.T) {
+	sub, _, _ := subscribeChanges("7", "b", "", "")
+	feed := sub.feed
+
+	// Events committed out of order are published in order.
+	feed.publish(&changeEvent{seq: 2, Bucket: "b", Key: "two"})
+	feed.publish(&changeEvent{seq: 1, Bucket: "b", Key: "one"})
+	if first, second := <-sub.events, <-sub.events; first.Key != "one" || second.Key != "two" {
+		t.Fatalf("Events were published out of order: %s, %s", first.Key, second.Key)
+	}
+
+	// The history is bounded by size.
+	for seq := uint64(3); seq < 10; seq++ {
+		feed.publish(&changeEvent{seq: seq, Bucket: "other", Value: make([]byte, 1<<20)})
+	}
+	feed.mu.Lock()
+	if feed.historyBytes > changeHistoryBytes || len(feed.history) >= 9 {
+		t.Fatalf("History holds %d events of %d bytes", len(feed.history), feed.historyBytes)
+	}
+	feed.mu.Unlock()
+
+	// A feed without subscribers is dropped once it was idle long enough.
+	feed.unsubscribe(sub)
+	feed.expire()
+	if feedFor("7") != feed {
+		t.Fatalf("Feed was dropped before it was idle long enough")
+	}
+	feed.mu.Lock()
+	feed.idleSince = time.Now().Add(-changeFeedIdle)
+	feed.mu.Unlock()
+	feed.expire()
+	if feedFor("7") != nil {
+		t.Fatalf("Idle feed was not dropped")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer teardownDatabase()
+
+	server := httptest.NewServer(routers)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/_ws"
+
+	dial := func(key string) *websocket.Conn {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"API-KEY": {key}})
+		if err != nil {
+			t.Fatalf("Dial failed: %v %v", err, resp)
+		}
+		return conn
+	}
+	recv := func(conn *websocket.Conn) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Reading a message failed: %v", err)
+		}
+		return msg
+	}
+	call := func(conn *websocket.Conn, req string) map[string]interface{} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatalf("Sending failed: %v", err)
+		}
+		return recv(conn)
+	}
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without an API key")
+	}
+
+	req := httptest.NewRequest("PUT", "/users", nil)
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+
+	conn := dial(apiKey)
+	defer conn.Close()
+
+	if msg := call(conn, `{"id": "s1", "op": "subscribe", "bucket": "users", "prefix": "user-"}`); msg["id"] != "s1" || msg["ok"] != true {
+		t.Fatalf("Subscribe failed: %v", msg)
+	}
+	if msg := call(conn, `{"id": "1", "op": "set", "bucket": "users", "key": "user-1", "value": {"name": "Alice"}}`); msg["id"] != "1" || msg["ok"] != true {
+		t.Fatalf("Set failed: %v", msg)
+	}
+	ev := recv(conn)
+	if ev["subscription"] != "s1" || ev["event"].(map[string]interface{})["key"] != "user-1" {
+		t.Fatalf("Unexpected event: %v", ev)
+	}
+	msg := call(conn, `{"id": "2", "op": "get", "bucket": "users", "key": "user-1"}`)
+	if msg["id"] != "2" || msg["value"].(map[string]interface{})["name"] != "Alice" {
+		t.Fatalf("Get failed: %v", msg)
+	}
+	if msg := call(conn, `{"id": "3", "op": "get", "bucket": "users", "key": "nobody"}`); msg["ok"] != false || msg["status"] != float64(404) {
+		t.Fatalf("Expected 404 for a missing key: %v", msg)
+	}
+	if msg := call(conn, `{"id": "4", "op": "subscribe", "bucket": "missing"}`); msg["status"] != float64(404) {
+		t.Fatalf("Expected 404 for a missing bucket: %v", msg)
+	}
+	if msg := call(conn, `{"id": "5", "op": "unsubscribe", "subscription": "s1"}`); msg["ok"] != true {
+		t.Fatalf("Unsubscribe failed: %v", msg)
+	}
+	// Without the subscription the delete is answered but not reported.
+	if msg := call(conn, `{"id": "6", "op": "delete", "bucket": "users", "key": "user-1"}`); msg["id"] != "6" || msg["ok"] != true {
+		t.Fatalf("Delete failed: %v", msg)
+	}
+	if msg := call(conn, `{"id": "7", "op": "get", "bucket": "users", "key": "user-1"}`); msg["id"] != "7" || msg["status"] != float64(404) {
+		t.Fatalf("Expected the key to be deleted: %v", msg)
+	}
+	if msg := call(conn, `not json`); msg["status"] != float64(400) {
+		t.Fatalf("Expected 400 for an invalid message: %v", msg)
+	}
+
+	// A read-only token can subscribe and read but not write.
+	w := httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/_tokens", strings.NewReader(`{"scope": "read"}`))
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(w, req)
+	var tok struct{ Token string }
+	json.NewDecoder(w.Body).Decode(&tok)
+	reader := dial(tok.Token)
+	defer reader.Close()
+	if msg := call(reader, `{"id": "1", "op": "subscribe", "bucket": "users"}`); msg["ok"] != true {
+		t.Fatalf("Read token could not subscribe: %v", msg)
+	}
+	if msg := call(reader, `{"id": "2", "op": "set", "bucket": "users", "key": "x", "value": 1}`); msg["status"] != float64(403) {
+		t.Fatalf("Expected 403 for a write with a read token: %v", msg)
+	}
+	if msg := call(reader, `{"id": "3", "op": "get", "bucket": "`+reservedBucket+`", "key": "x"}`); msg["status"] != float64(405) {
+		t.Fatalf("Expected 405 for the reserved bucket as over HTTP: %v", msg)
+	}
+
+	// Revoking the token closes connections opened with it.
+	revoked := dial(tok.Token)
+	defer revoked.Close()
+	req = httptest.NewRequest("DELETE", "/_tokens/"+tokenID(tok.Token), nil)
+	req.Header.Set("API-KEY", apiKey)
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	revoked.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "op": "get", "bucket": "users", "key": "x"}`))
+	revoked.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := revoked.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("Expected the connection to be closed after revoking its token, got %v", err)
+	}
+
+	// Values of other media types are base64 encoded, as in batch responses.
+	req = httptest.NewRequest("PUT", "/users/note", strings.NewReader("hi"))
+	req.Header.Set("API-KEY", apiKey)
+	req.Header.Set("Content-Type", "text/plain")
+	routers.ServeHTTP(httptest.NewRecorder(), req)
+	if msg := call(conn, `{"id": "8", "op": "get", "bucket": "users", "key": "note"}`); msg["base64"] != "aGk=" || msg["content_type"] != "text/plain" {
+		t.Fatalf("Unexpected non-JSON value: %v", msg)
+	}
+
+	// Browsers offer the key as a subprotocol, and other origins must be
+	// allowed explicitly.
+	browser := websocket.Dialer{Subprotocols: []string{wsProtocol, wsKeyProtocol + apiKey}}
+	origin := http.Header{"Origin": {server.URL}}
+	page, resp, err := browser.Dial(wsURL, origin)
+	if err != nil || resp.Header.Get("Sec-WebSocket-Protocol") != wsProtocol {
+		t.Fatalf("Browser handshake failed: %v %v", err, resp)
+	}
+	defer page.Close()
+	if msg := call(page, `{"id": "1", "op": "get", "bucket": "users", "key": "note"}`); msg["ok"] != true {
+		t.Fatalf("Browser connection could not read: %v", msg)
+	}
+	origin.Set("Origin", "https://elsewhere.example")
+	if _, resp, err := browser.Dial(wsURL, origin); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for another origin")
+	}
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://elsewhere.example")
+	other, _, err := browser.Dial(wsURL, origin)
+	if err != nil {
+		t.Fatalf("Allowed origin was rejected: %v", err)
+	}
+	other.Close()
+}
+
 func TestMain(m *testing.M) {
 	// Set the MASTER_API_KEY environment variable for testing
 
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyPattern matches the keys issued by the Telegram bot: the owner's
+// numeric user ID, a dash and 32 lowercase hex characters.
+var apiKeyPattern = regexp.MustCompile(`^([0-9]{1,20})-[0-9a-f]{32}$`)
+
+// storeRescanInterval limits how often an unknown owner ID triggers a
+// rescan of dataPath.
+var storeRescanInterval = time.Second
+
+var errInvalidApiKey = errors.New("Invalid API key")
+
+type contextKey int
+
+const tenantContextKey contextKey = iota
+
+// tenant is a resolved store: the owner ID embedded in its API key and
+// the bbolt file that backs it.
+type tenant struct {
+	id     string
+	apiKey string
+	path   string
+	// registered is the storeIndex generation of RegisterStore calls it
+	// was added by, zero when it was found by a scan.
+	registered uint64
+}
+
+var stores = newStoreIndex()
+
+// storeIndex maps owner IDs to store files. It is filled by scanning
+// dataPath, so file names are only ever taken from the directory listing
+// and never from a request header.
+type storeIndex struct {
+	mu       sync.Mutex
+	tenants  map[string]*tenant
+	lastScan time.Time
+	// generation counts RegisterStore calls, so a rescan keeps the stores
+	// registered while it listed the directory.
+	generation uint64
+}
+
+func newStoreIndex() *storeIndex {
+	return &storeIndex{tenants: make(map[string]*tenant)}
+}
+
+// RegisterStore makes a store file created at path resolvable right away,
+// without waiting for the next rescan of the data directory.
+func RegisterStore(path string) {
+	stores.mu.Lock()
+	defer stores.mu.Unlock()
+	stores.generation++
+	if t := newTenant(path); t != nil {
+		if _, exists := stores.tenants[t.id]; !exists {
+			t.registered = stores.generation
+			stores.tenants[t.id] = t
+		}
+	}
+}
+
+// resolve returns the store of the owner ID embedded in apiKey and
+// whether apiKey is the store's own key. Other keys of the store, such as
+// tokens, are checked by the caller, so only an unknown owner ID triggers
+// a rescan of dataPath.
+func (s *storeIndex) resolve(apiKey string) (*tenant, bool, error) {
+	m := apiKeyPattern.FindStringSubmatch(apiKey)
+	if m == nil {
+		return nil, false, errInvalidApiKey
+	}
+	t, err := s.find(m[1])
+	if err != nil {
+		return nil, false, err
+	}
+	if t == nil {
+		return nil, false, errInvalidApiKey
+	}
+	return t, keysEqual(t.apiKey, apiKey), nil
+}
+
+// lookup returns the store of an owner ID, like resolve without a key.
+func (s *storeIndex) lookup(id string) (*tenant, bool) {
+	t, err := s.find(id)
+	return t, err == nil && t != nil
+}
+
+// find returns the store of an owner ID, or nil when there is none. An
+// unknown ID triggers a rescan of dataPath at most every
+// storeRescanInterval.
+func (s *storeIndex) find(id string) (*tenant, error) {
+	s.mu.Lock()
+	t := s.tenants[id]
+	rescan := t == nil && time.Since(s.lastScan) >= storeRescanInterval
+	if rescan {
+		// Concurrent misses wait for the next interval instead of
+		// listing the directory too.
+		s.lastScan = time.Now()
+	}
+	s.mu.Unlock()
+	if !rescan {
+		return t, nil
+	}
+
+	if err := s.rescan(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tenants[id], nil
+}
+
+// all rescans dataPath and returns every known store.
+func (s *storeIndex) all() ([]*tenant, error) {
+	if err := s.rescan(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenants := make([]*tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// rescan replaces the index with the stores in dataPath. The directory is
+// listed without holding mu, so requests for known stores do not wait for
+// it; stores registered in the meantime are kept.
+func (s *storeIndex) rescan() error {
+	s.mu.Lock()
+	since := s.generation
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	tenants := make(map[string]*tenant)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		t := newTenant(filepath.Join(dataPath, entry.Name()))
+		if t == nil {
+			continue
+		}
+		if _, exists := tenants[t.id]; !exists {
+			tenants[t.id] = t
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.tenants {
+		if t.registered > since {
+			tenants[id] = t
+		}
+	}
+	s.tenants = tenants
+	s.lastScan = time.Now()
+	return nil
+}
+
+// newTenant returns the store of the file at path, or nil when its name
+// is not a valid API key followed by .db.
+func newTenant(path string) *tenant {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, ".db") {
+		return nil
+	}
+	apiKey := strings.TrimSuffix(name, ".db")
+	m := apiKeyPattern.FindStringSubmatch(apiKey)
+	if m == nil {
+		return nil
+	}
+	return &tenant{id: m[1], apiKey: apiKey, path: path}
+}
+
+// forget drops the index entry for a store file, e.g. after it was renamed.
+func (s *storeIndex) forget(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.tenants {
+		if poolKey(t.path) == poolKey(path) {
+			delete(s.tenants, id)
+		}
+	}
+}
+
+func keysEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func withTenant(r *http.Request, t *tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey, t))
+}
+
+func tenantFromRequest(r *http.Request) (*tenant, bool) {
+	t, ok := r.Context().Value(tenantContextKey).(*tenant)
+	return t, ok
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type batchKeysRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type batchPutRequest struct {
+	Items []batchPutItem `json:"items"`
+}
+
+type batchPutItem struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	TTL   string          `json:"ttl,omitempty"`
+}
+
+// batchItem is one entry of a batch response.
+type batchItem struct {
+	Key   string `json:"key"`
+	Found bool   `json:"found"`
+	itemValue
+}
+
+// itemValue is a value embedded in a JSON response. JSON values are
+// inlined in Value; other media types are returned base64 encoded.
+type itemValue struct {
+	Value       json.RawMessage `json:"value,omitempty"`
+	Base64      []byte          `json:"base64,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	ETag        string          `json:"etag,omitempty"`
+}
+
+var errBatchNoKey = errors.New("every item needs a non-empty key")
+
+func batchGet(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req batchKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	items := make([]batchItem, len(req.Keys))
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		for i, key := range req.Keys {
+			items[i].Key = key
+			rec, err := getRecord(bucket, []byte(key))
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				items[i].Found = true
+				items[i].fill(rec.clone())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]batchItem{"items": items})
+}
+
+func batchPut(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, path, true) {
+		return
+	}
+
+	var req batchPutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	records := make([]*record, len(req.Items))
+	for i, item := range req.Items {
+		if item.Key == "" {
+			http.Error(w, errBatchNoKey.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(item.Value) == 0 || !json.Valid(item.Value) {
+			http.Error(w, "Value of '"+item.Key+"' must be a valid JSON document", http.StatusBadRequest)
+			return
+		}
+		records[i] = &record{Value: item.Value}
+		if item.TTL != "" {
+			ttl, err := parseDuration(item.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			records[i].ExpiresAt = now.Add(ttl).UnixMilli()
+		}
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	// db.Batch coalesces concurrent writers into one commit. The function
+	// may run more than once, which is fine since it only overwrites.
+	err = db.Batch(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		for i, item := range req.Items {
+			if err := putRecord(bucket, path, []byte(item.Key), records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	items := make([]batchItem, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = batchItem{Key: item.Key, Found: true}
+		items[i].ETag = records[i].etag()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]batchItem{"items": items})
+}
+
+func batchDelete(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, path, true) {
+		return
+	}
+
+	var req batchKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, key := range req.Keys {
+		if key == "" {
+			http.Error(w, errBatchNoKey.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var items []batchItem
+	err = db.Batch(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		// Reset on every run, since db.Batch may retry this function.
+		items = make([]batchItem, len(req.Keys))
+		for i, key := range req.Keys {
+			rec, err := getRecord(bucket, []byte(key))
+			if err != nil {
+				return err
+			}
+			items[i] = batchItem{Key: key, Found: rec != nil}
+			if err := deleteRecord(bucket, path, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]batchItem{"items": items})
+}
+
+func (item *itemValue) fill(rec *record) {
+	item.ETag = rec.etag()
+	if rec.ContentType == "" {
+		item.Value = rec.Value
+		return
+	}
+	item.ContentType = rec.ContentType
+	item.Base64 = rec.Value
+}
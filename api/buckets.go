@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	errInvalidBucketPath = errors.New("Invalid bucket path")
+	errReservedName      = errors.New("Names starting with '_' are reserved")
+)
+
+// bucketPath returns the nested bucket a request addresses. Routes capture
+// it in the bucketPath variable as slash-separated names, outermost first,
+// so /api/app/users/eu/123 addresses key 123 in bucket app/users/eu.
+func bucketPath(r *http.Request) ([][]byte, error) {
+	return splitBucketPath(mux.Vars(r)["bucketPath"])
+}
+
+// splitBucketPath parses a slash-separated bucket path. Empty names are rejected.
+func splitBucketPath(path string) ([][]byte, error) {
+	if path == "" {
+		return nil, errInvalidBucketPath
+	}
+	names := strings.Split(path, "/")
+	segments := make([][]byte, len(names))
+	for i, name := range names {
+		if name == "" {
+			return nil, errInvalidBucketPath
+		}
+		segments[i] = []byte(name)
+	}
+	return segments, nil
+}
+
+// getBucket walks down a nested bucket path. It returns nil when any
+// bucket along the path does not exist.
+func getBucket(tx *bbolt.Tx, path [][]byte) *bbolt.Bucket {
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(name)
+	}
+	return bucket
+}
+
+// checkName rejects the key and bucket names reserved for endpoints such
+// as _scan, _stats or _schema, which would otherwise shadow them.
+func checkName(name []byte) error {
+	if len(name) > 0 && name[0] == '_' {
+		return errReservedName
+	}
+	return nil
+}
+
+// createBucketPath creates every missing bucket along path.
+func createBucketPath(tx *bbolt.Tx, path [][]byte) (*bbolt.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+	return bucket, err
+}
+
+// deleteBucketPath deletes the last bucket of path from its parent.
+func deleteBucketPath(tx *bbolt.Tx, path [][]byte) error {
+	if len(path) == 1 {
+		return tx.DeleteBucket(path[0])
+	}
+	parent := getBucket(tx, path[:len(path)-1])
+	if parent == nil {
+		return bbolt.ErrBucketNotFound
+	}
+	return parent.DeleteBucket(path[len(path)-1])
+}
+
+// walkBuckets calls fn for every bucket of the store except the reserved
+// one, parents before their children.
+func walkBuckets(tx *bbolt.Tx, fn func(path [][]byte, bucket *bbolt.Bucket) error) error {
+	return tx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+		if string(name) == reservedBucket {
+			return nil
+		}
+		return walkNested([][]byte{name}, bucket, fn)
+	})
+}
+
+func walkNested(path [][]byte, bucket *bbolt.Bucket, fn func(path [][]byte, bucket *bbolt.Bucket) error) error {
+	if err := fn(path, bucket); err != nil {
+		return err
+	}
+	return bucket.ForEachBucket(func(name []byte) error {
+		child := append(append([][]byte(nil), path...), name)
+		return walkNested(child, bucket.Bucket(name), fn)
+	})
+}
+
+// pathKey joins a bucket path back into its slash-separated form. Bucket
+// names cannot contain slashes, so it identifies the path unambiguously.
+func pathKey(path [][]byte) string {
+	return string(bytes.Join(path, []byte("/")))
+}
+
+// systemBucket walks down names inside the reserved bucket. It returns nil
+// when any of them does not exist.
+func systemBucket(tx *bbolt.Tx, names ...string) *bbolt.Bucket {
+	return getBucket(tx, systemPath(names))
+}
+
+// createSystemBucket creates every missing bucket along names inside the
+// reserved bucket.
+func createSystemBucket(tx *bbolt.Tx, names ...string) (*bbolt.Bucket, error) {
+	return createBucketPath(tx, systemPath(names))
+}
+
+func systemPath(names []string) [][]byte {
+	path := [][]byte{[]byte(reservedBucket)}
+	for _, name := range names {
+		path = append(path, []byte(name))
+	}
+	return path
+}
+
+// bucketAreas are the buckets inside the reserved bucket that hold data
+// about user buckets, keyed by bucket path.
+var bucketAreas = []string{indexesBucket, schemasBucket, metaBucket}
+
+// dropBucketAreas removes what bucketAreas hold about the bucket at path
+// and every bucket nested in it.
+func dropBucketAreas(tx *bbolt.Tx, path [][]byte) error {
+	key := []byte(pathKey(path))
+	for _, area := range bucketAreas {
+		root := systemBucket(tx, area)
+		if root == nil {
+			continue
+		}
+		var names [][]byte
+		c := root.Cursor()
+		for k, _ := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, _ = c.Next() {
+			if len(k) == len(key) || k[len(key)] == '/' {
+				names = append(names, append([]byte(nil), k...))
+			}
+		}
+		for _, name := range names {
+			var err error
+			if root.Bucket(name) != nil {
+				err = root.DeleteBucket(name)
+			} else {
+				err = root.Delete(name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
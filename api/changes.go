@@ -0,0 +1,404 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// changeHistorySize and changeHistoryBytes bound the recent events a
+	// feed keeps so clients can resume with Last-Event-ID.
+	changeHistorySize  = 1024
+	changeHistoryBytes = 4 << 20
+	// changeBufferSize is how many events a subscriber may fall behind
+	// before it is disconnected.
+	changeBufferSize = 256
+	// changeHeartbeat is how often an idle stream sends a comment, which
+	// keeps proxies from closing it, and checks its credential again.
+	changeHeartbeat = 30 * time.Second
+	// changeFeedIdle is how long a feed and its history are kept after its
+	// last subscriber left.
+	changeFeedIdle = 10 * time.Minute
+)
+
+// changesBucket holds the number of the last event published by a
+// committed transaction, so numbers are assigned in commit order. It
+// lives inside the reserved bucket.
+const changesBucket = "changes"
+
+var lastEventKey = []byte("last")
+
+// changeEvent is a committed write to a key, or a reset of a bucket that
+// was deleted, replaced or renamed as a whole and has no Key.
+type changeEvent struct {
+	id          string
+	seq         uint64
+	Type        string          `json:"type"`
+	Bucket      string          `json:"bucket"`
+	Key         string          `json:"key,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	ETag        string          `json:"etag,omitempty"`
+	// Time is the time of the write in Unix milliseconds.
+	Time int64 `json:"time"`
+}
+
+// size approximates the memory the event holds on to.
+func (ev *changeEvent) size() int {
+	return len(ev.id) + len(ev.Bucket) + len(ev.Key) + len(ev.Value) + len(ev.ContentType) + len(ev.ETag) + 64
+}
+
+// changeFeed is the event bus of one store. Events are numbered in commit
+// order and published in that order; epoch tells numbers of an earlier
+// feed (e.g. before a restart) apart, since those cannot be resumed.
+type changeFeed struct {
+	owner string
+	epoch int64
+
+	mu sync.Mutex
+	// published is the number of the last published event. Events whose
+	// transactions committed out of order wait in pending.
+	published    uint64
+	pending      map[uint64]*changeEvent
+	history      []*changeEvent
+	historyBytes int
+	subs         map[*subscription]struct{}
+	idleSince    time.Time
+	idle         *time.Timer
+}
+
+// subscription receives the events of one bucket, limited to the keys
+// starting with prefix. Its channel is closed when it falls behind.
+type subscription struct {
+	feed   *changeFeed
+	bucket string
+	prefix string
+	events chan *changeEvent
+}
+
+// matches reports whether ev concerns the subscription. A reset of a
+// bucket also concerns the subscriptions to the buckets nested in it.
+func (s *subscription) matches(ev *changeEvent) bool {
+	if ev.Type == "reset" {
+		return ev.Bucket == s.bucket || strings.HasPrefix(s.bucket, ev.Bucket+"/")
+	}
+	return ev.Bucket == s.bucket && strings.HasPrefix(ev.Key, s.prefix)
+}
+
+// feeds maps owner IDs to the feeds of their stores. A feed is created by
+// its first subscriber and dropped once it had none for changeFeedIdle;
+// writes to stores without a feed are not recorded.
+var feeds = struct {
+	sync.Mutex
+	stores map[string]*changeFeed
+}{stores: make(map[string]*changeFeed)}
+
+// feedFor returns the feed of the store with owner ID id, or nil.
+func feedFor(id string) *changeFeed {
+	feeds.Lock()
+	defer feeds.Unlock()
+	return feeds.stores[id]
+}
+
+// subscribeChanges subscribes to the feed of the store with owner ID id,
+// creating the feed when needed. See changeFeed.subscribe.
+func subscribeChanges(id, bucket, prefix, lastEventID string) (*subscription, []*changeEvent, bool) {
+	feeds.Lock()
+	defer feeds.Unlock()
+	feed, ok := feeds.stores[id]
+	if !ok {
+		feed = &changeFeed{
+			owner:   id,
+			epoch:   time.Now().UnixMilli(),
+			pending: make(map[uint64]*changeEvent),
+			subs:    make(map[*subscription]struct{}),
+		}
+		feeds.stores[id] = feed
+	}
+	return feed.subscribe(bucket, prefix, lastEventID)
+}
+
+// storeOwner returns the owner ID of the store a transaction belongs to.
+// Store files are named after their primary key, which starts with it.
+func storeOwner(tx *bbolt.Tx) string {
+	name := strings.TrimSuffix(filepath.Base(tx.DB().Path()), ".db")
+	if m := apiKeyPattern.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// publishChange publishes an event for the write of rec to key, or its
+// deletion when rec is nil, once tx commits.
+func publishChange(tx *bbolt.Tx, path [][]byte, key []byte, rec *record) error {
+	ev := &changeEvent{Type: "delete", Bucket: pathKey(path), Key: string(key)}
+	if rec != nil {
+		ev.Type = "put"
+		ev.ETag = rec.etag()
+		if rec.ContentType == "" {
+			ev.Value = append(json.RawMessage(nil), rec.Value...)
+		} else {
+			ev.ContentType = rec.ContentType
+		}
+	}
+	return publishEvent(tx, ev)
+}
+
+// publishReset tells the subscribers of the bucket at path, and of the
+// buckets nested in it, that it was deleted, replaced or renamed as a
+// whole once tx commits, so they should reload it. Its keys are not
+// reported one by one.
+func publishReset(tx *bbolt.Tx, path [][]byte) error {
+	return publishEvent(tx, &changeEvent{Type: "reset", Bucket: pathKey(path)})
+}
+
+// publishEvent numbers ev and publishes it once tx commits.
+//
+// Commit handlers run after bbolt released the writer lock, so they may
+// run out of commit order. The number is assigned here instead, under the
+// writer lock, from the last number stored in the store: a transaction
+// that rolls back leaves no trace, so the numbers of committed events
+// have no gaps and the feed can publish them in order.
+func publishEvent(tx *bbolt.Tx, ev *changeEvent) error {
+	feed := feedFor(storeOwner(tx))
+	if feed == nil {
+		return nil
+	}
+	changes, err := createSystemBucket(tx, changesBucket)
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	if last := changes.Get(lastEventKey); len(last) == 16 && int64(binary.BigEndian.Uint64(last)) == feed.epoch {
+		seq = binary.BigEndian.Uint64(last[8:])
+	}
+	seq++
+	last := make([]byte, 16)
+	binary.BigEndian.PutUint64(last, uint64(feed.epoch))
+	binary.BigEndian.PutUint64(last[8:], seq)
+	if err := changes.Put(lastEventKey, last); err != nil {
+		return err
+	}
+
+	ev.id = fmt.Sprintf("%d-%d", feed.epoch, seq)
+	ev.seq = seq
+	ev.Time = time.Now().UnixMilli()
+	tx.OnCommit(func() {
+		feed.publish(ev)
+	})
+	return nil
+}
+
+// publish publishes ev and the pending events following it, once every
+// event before it has been published.
+func (f *changeFeed) publish(ev *changeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[ev.seq] = ev
+	for {
+		ev, ok := f.pending[f.published+1]
+		if !ok {
+			return
+		}
+		delete(f.pending, ev.seq)
+		f.published = ev.seq
+		f.record(ev)
+		for sub := range f.subs {
+			if !sub.matches(ev) {
+				continue
+			}
+			select {
+			case sub.events <- ev:
+			default:
+				// A subscriber that falls behind is disconnected. It can
+				// resume from the last event it received.
+				f.removeLocked(sub)
+			}
+		}
+	}
+}
+
+// record appends ev to the history, dropping the oldest events beyond
+// its bounds.
+func (f *changeFeed) record(ev *changeEvent) {
+	f.history = append(f.history, ev)
+	f.historyBytes += ev.size()
+	drop := 0
+	for drop < len(f.history)-1 && (len(f.history)-drop > changeHistorySize || f.historyBytes > changeHistoryBytes) {
+		f.historyBytes -= f.history[drop].size()
+		f.history[drop] = nil
+		drop++
+	}
+	f.history = f.history[drop:]
+}
+
+// subscribe registers a subscription. When lastEventID is set it also
+// returns the matching events published after it, or reset when those
+// are no longer known.
+func (f *changeFeed) subscribe(bucket, prefix, lastEventID string) (sub *subscription, backlog []*changeEvent, reset bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub = &subscription{feed: f, bucket: bucket, prefix: prefix, events: make(chan *changeEvent, changeBufferSize)}
+	f.subs[sub] = struct{}{}
+	if f.idle != nil {
+		f.idle.Stop()
+	}
+	if lastEventID == "" {
+		return sub, nil, false
+	}
+
+	epoch, seq, ok := parseEventID(lastEventID)
+	if !ok || epoch != f.epoch || seq > f.published {
+		return sub, nil, true
+	}
+	if len(f.history) > 0 && seq+1 < f.history[0].seq {
+		reset = true
+	}
+	for _, ev := range f.history {
+		if ev.seq > seq && sub.matches(ev) {
+			backlog = append(backlog, ev)
+		}
+	}
+	return sub, backlog, reset
+}
+
+func (f *changeFeed) unsubscribe(sub *subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[sub]; ok {
+		f.removeLocked(sub)
+	}
+}
+
+// removeLocked ends a subscription. A feed left without subscribers is
+// dropped after changeFeedIdle unless one arrives in the meantime.
+func (f *changeFeed) removeLocked(sub *subscription) {
+	delete(f.subs, sub)
+	close(sub.events)
+	if len(f.subs) > 0 {
+		return
+	}
+	f.idleSince = time.Now()
+	if f.idle == nil {
+		f.idle = time.AfterFunc(changeFeedIdle, f.expire)
+	} else {
+		f.idle.Reset(changeFeedIdle)
+	}
+}
+
+func (f *changeFeed) expire() {
+	feeds.Lock()
+	defer feeds.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) == 0 && time.Since(f.idleSince) >= changeFeedIdle && feeds.stores[f.owner] == f {
+		delete(feeds.stores, f.owner)
+	}
+}
+
+func parseEventID(id string) (epoch int64, seq uint64, ok bool) {
+	e, s, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	epoch, err := strconv.ParseInt(e, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseUint(s, 10, 64)
+	return epoch, seq, err == nil
+}
+
+// streamChanges streams the writes to the keys of a bucket, optionally
+// under a prefix, as Server-Sent Events. A client that reconnects with
+// Last-Event-ID (or ?last_event_id=) receives the events it missed; when
+// they are no longer known it receives a "reset" event and should reload,
+// as after the bucket was deleted, replaced or renamed as a whole.
+func streamChanges(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	// The store is not kept open while streaming, so the stream does not
+	// hold up key rotations.
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if getBucket(tx, path) == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		return nil
+	})
+	release()
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	t, _ := tenantFromRequest(r)
+	sub, backlog, reset := subscribeChanges(t.id, pathKey(path), r.URL.Query().Get("prefix"), lastEventID)
+	defer sub.feed.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if reset {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, ev := range backlog {
+		writeChangeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeChangeEvent(w, ev)
+		case <-heartbeat.C:
+			// A revoked or expired token or key ends the stream; the
+			// client's reconnect is then refused.
+			if _, _, err := authenticate(requestApiKey(r)); err == errInvalidApiKey {
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeChangeEvent(w http.ResponseWriter, ev *changeEvent) {
+	// Marshaling compacts the value, so the event data fits on one line.
+	data, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.id, ev.Type, data)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers of a
+// write against current, the stored value (nil when the key is absent).
+// "If-None-Match: *" makes a PUT create-only; "If-Match" turns PUT and
+// DELETE into a compare-and-swap on the value's ETag.
+func checkPreconditions(r *http.Request, current *record) error {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if current == nil || !etagListMatches(ifMatch, current.etag()) {
+			return errPreconditionFailed
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if current != nil && etagListMatches(ifNoneMatch, current.etag()) {
+			return errPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// notModified reports whether a GET can be answered with 304 because the
+// client's If-None-Match already names the current ETag.
+func notModified(r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	return ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag)
+}
+
+// etagListMatches reports whether a comma-separated If-Match/If-None-Match
+// header value contains etag or the "*" wildcard. Weak tags never match,
+// since every ETag kvrest hands out is strong.
+func etagListMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
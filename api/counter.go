@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+var errNotANumber = errors.New("value is not a number")
+
+// incrRequest is the optional body of POST /{bucket}/{key}/_incr. Delta
+// defaults to 1. Field is a JSON Pointer to a number inside a stored
+// object; without it the whole value is the counter. Min and Max clamp
+// the result.
+type incrRequest struct {
+	Delta *json.Number `json:"delta"`
+	Field string       `json:"field"`
+	Min   *json.Number `json:"min"`
+	Max   *json.Number `json:"max"`
+}
+
+// incrementKey atomically adds a delta to a numeric value, or to a numeric
+// field of a JSON object, inside one write transaction. Missing keys and
+// fields start at zero.
+func incrementKey(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, path, true) {
+		return
+	}
+
+	var req incrRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	delta := json.Number("1")
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+	field, err := parsePointer(req.Field)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseTTL(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var result json.Number
+	var rec *record
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		current, err := getRecord(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, current); err != nil {
+			return err
+		}
+
+		var doc interface{}
+		rec = &record{ExpiresAt: expiresAt}
+		if current != nil {
+			if current.ContentType != "" {
+				return errNotANumber
+			}
+			if doc, err = decodeJSON(current.Value); err != nil {
+				return err
+			}
+			if expiresAt == 0 {
+				rec.ExpiresAt = current.ExpiresAt
+			}
+		}
+
+		counter := json.Number("0")
+		if value, ok := pointerGet(doc, field); ok && value != nil {
+			if counter, ok = value.(json.Number); !ok {
+				return errNotANumber
+			}
+		}
+		if result, err = addNumbers(counter, delta); err != nil {
+			return err
+		}
+		if result, err = clampNumber(result, req.Min, req.Max); err != nil {
+			return err
+		}
+		if doc, err = pointerSet(doc, field, result); err != nil {
+			return err
+		}
+		if rec.Value, err = encodeJSON(doc); err != nil {
+			return err
+		}
+		return putRecord(bucket, path, []byte(key), rec)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", rec.etag())
+	json.NewEncoder(w).Encode(map[string]json.Number{"value": result})
+}
+
+// addNumbers adds two JSON numbers, exactly when both are integers that
+// do not overflow int64 and in floating point otherwise.
+func addNumbers(a, b json.Number) (json.Number, error) {
+	ai, aErr := a.Int64()
+	bi, bErr := b.Int64()
+	if aErr == nil && bErr == nil {
+		sum := ai + bi
+		if (bi >= 0) == (sum >= ai) {
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+	af, err := a.Float64()
+	if err != nil {
+		return "", errNotANumber
+	}
+	bf, err := b.Float64()
+	if err != nil {
+		return "", errNotANumber
+	}
+	return formatFloat(af + bf)
+}
+
+// clampNumber limits n to the optional [min, max] interval.
+func clampNumber(n json.Number, min, max *json.Number) (json.Number, error) {
+	value, err := n.Float64()
+	if err != nil {
+		return "", errNotANumber
+	}
+	if min != nil {
+		bound, err := min.Float64()
+		if err != nil {
+			return "", errNotANumber
+		}
+		if value < bound {
+			return *min, nil
+		}
+	}
+	if max != nil {
+		bound, err := max.Float64()
+		if err != nil {
+			return "", errNotANumber
+		}
+		if value > bound {
+			return *max, nil
+		}
+	}
+	return n, nil
+}
+
+func formatFloat(f float64) (json.Number, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", errNotANumber
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
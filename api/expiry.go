@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// sweepBatchSize bounds how many expired keys one write transaction deletes,
+// so the sweeper never holds a store's write lock for long.
+var sweepBatchSize = 500
+
+// The expiry index lives inside the reserved bucket. Its due bucket has an
+// entry for every key with a TTL, ordered by expiry time, so the sweeper
+// only reads the keys that are due. indexedKey marks stores whose keys
+// written before the index existed have been added to it.
+const (
+	expiryBucket = "expiry"
+	expiryDue    = "due"
+)
+
+var expiryIndexedKey = []byte("indexed")
+
+// noExpiry is the due time of a store without keys that expire.
+const noExpiry = math.MaxInt64
+
+// expirySchedule remembers when the earliest indexed key of each store
+// file expires, so the sweeper leaves stores with nothing due closed.
+// Stores it has not visited since startup are missing and always visited.
+type expirySchedule struct {
+	mu  sync.Mutex
+	due map[string]int64
+}
+
+var expiries = &expirySchedule{due: make(map[string]int64)}
+
+// schedule records a committed key of the store at path that expires at.
+func (s *expirySchedule) schedule(path string, at int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if due, ok := s.due[path]; ok && at < due {
+		s.due[path] = at
+	}
+}
+
+// visit starts a sweep of the store at path. Keys committed while it runs
+// are scheduled, and the sweep adds what is left in the index with
+// schedule when it is done.
+func (s *expirySchedule) visit(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.due[path] = noExpiry
+}
+
+// pending reports whether the store at path may have keys due at now.
+func (s *expirySchedule) pending(path string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due, ok := s.due[path]
+	return !ok || due <= now.UnixMilli()
+}
+
+// retain forgets the stores whose paths are not in paths.
+func (s *expirySchedule) retain(paths map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.due {
+		if !paths[path] {
+			delete(s.due, path)
+		}
+	}
+}
+
+// StartExpirySweeper periodically deletes expired keys from every store
+// that has keys due. It blocks, so run it in its own goroutine.
+func StartExpirySweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tenants, err := stores.all()
+		if err != nil {
+			log.Printf("Expiry sweep failed to list stores: %s", err)
+			continue
+		}
+		paths := make(map[string]bool, len(tenants))
+		for _, t := range tenants {
+			paths[poolKey(t.path)] = true
+			if !expiries.pending(poolKey(t.path), time.Now()) {
+				continue
+			}
+			deleted, err := sweepStore(t.path)
+			if err != nil {
+				log.Printf("Expiry sweep failed for store %s: %s", t.id, err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Expiry sweep deleted %d keys from store %s", deleted, t.id)
+			}
+		}
+		expiries.retain(paths)
+	}
+}
+
+// sweepStore deletes the expired keys of the store at path. It reads the
+// due entries of the expiry index with read transactions and deletes them
+// in small write transactions, re-checking each key before deleting it in
+// case it was overwritten in between.
+func sweepStore(path string) (int, error) {
+	db, release, err := pool.acquire(path)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	if err := indexExpiries(db); err != nil {
+		return 0, err
+	}
+	key := poolKey(path)
+	expiries.visit(key)
+
+	total := 0
+	for {
+		var entries [][]byte
+		next := int64(noExpiry)
+		now := time.Now()
+		err := db.View(func(tx *bbolt.Tx) error {
+			due := systemBucket(tx, expiryBucket, expiryDue)
+			if due == nil {
+				return nil
+			}
+			c := due.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if at := int64(binary.BigEndian.Uint64(k)); at > now.UnixMilli() || len(entries) == sweepBatchSize {
+					next = at
+					break
+				}
+				entries = append(entries, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil || len(entries) == 0 {
+			expiries.schedule(key, next)
+			return total, err
+		}
+
+		err = db.Update(func(tx *bbolt.Tx) error {
+			due := systemBucket(tx, expiryBucket, expiryDue)
+			if due == nil {
+				return nil
+			}
+			for _, entry := range entries {
+				if err := due.Delete(entry); err != nil {
+					return err
+				}
+				at, path, k, ok := parseExpiryEntry(entry)
+				if !ok {
+					continue
+				}
+				// Entries of keys that were deleted with their bucket or
+				// moved elsewhere are only dropped here.
+				bucket := getBucket(tx, path)
+				if bucket == nil {
+					continue
+				}
+				data := bucket.Get(k)
+				if data == nil {
+					continue
+				}
+				rec, err := decodeRecord(data)
+				if err != nil || rec.ExpiresAt != at || !rec.expired(now) {
+					continue
+				}
+				if err := deleteRecord(bucket, path, k); err != nil {
+					return err
+				}
+				total++
+			}
+			return nil
+		})
+		if err != nil {
+			expiries.schedule(key, 0)
+			return total, err
+		}
+	}
+}
+
+// expiryEntry returns the expiry index entry of key in the bucket at path:
+// the expiry time, so entries sort by it, then the bucket path and the key.
+func expiryEntry(at int64, path [][]byte, key []byte) []byte {
+	p := pathKey(path)
+	entry := make([]byte, 8, 8+binary.MaxVarintLen64+len(p)+len(key))
+	binary.BigEndian.PutUint64(entry, uint64(at))
+	entry = binary.AppendUvarint(entry, uint64(len(p)))
+	entry = append(entry, p...)
+	return append(entry, key...)
+}
+
+// parseExpiryEntry splits an entry made by expiryEntry.
+func parseExpiryEntry(entry []byte) (int64, [][]byte, []byte, bool) {
+	if len(entry) < 8 {
+		return 0, nil, nil, false
+	}
+	n, size := binary.Uvarint(entry[8:])
+	if size <= 0 || uint64(len(entry)-8-size) < n {
+		return 0, nil, nil, false
+	}
+	p := entry[8+size : 8+size+int(n)]
+	return int64(binary.BigEndian.Uint64(entry)), bytes.Split(p, []byte("/")), entry[8+size+int(n):], true
+}
+
+// updateExpiry keeps the expiry index in step with a write of key in
+// bucket, which stores rec or, when rec is nil, deletes the key.
+func updateExpiry(bucket *bbolt.Bucket, path [][]byte, key []byte, rec *record) error {
+	var old, at int64
+	if data := bucket.Get(key); len(data) > 0 && data[0] == recordMagic {
+		stored, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+		old = stored.ExpiresAt
+	}
+	if rec != nil {
+		at = rec.ExpiresAt
+	}
+	if old == at {
+		return nil
+	}
+	if old != 0 {
+		if due := systemBucket(bucket.Tx(), expiryBucket, expiryDue); due != nil {
+			if err := due.Delete(expiryEntry(old, path, key)); err != nil {
+				return err
+			}
+		}
+	}
+	if at == 0 {
+		return nil
+	}
+	return indexExpiry(bucket.Tx(), path, key, at)
+}
+
+// indexExpiry adds key in the bucket at path, which expires at, to the
+// expiry index and schedules the store for it once tx commits.
+func indexExpiry(tx *bbolt.Tx, path [][]byte, key []byte, at int64) error {
+	due, err := createSystemBucket(tx, expiryBucket, expiryDue)
+	if err != nil {
+		return err
+	}
+	if err := due.Put(expiryEntry(at, path, key), []byte{}); err != nil {
+		return err
+	}
+	store := poolKey(tx.DB().Path())
+	tx.OnCommit(func() {
+		expiries.schedule(store, at)
+	})
+	return nil
+}
+
+// indexBucketExpiries adds the keys with a TTL stored in bucket, which
+// lives at path, to the expiry index, e.g. after they were copied there.
+func indexBucketExpiries(tx *bbolt.Tx, path [][]byte, bucket *bbolt.Bucket) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		if len(v) == 0 || v[0] != recordMagic {
+			return nil
+		}
+		rec, err := decodeRecord(v)
+		if err != nil || rec.ExpiresAt == 0 {
+			return err
+		}
+		return indexExpiry(tx, path, k, rec.ExpiresAt)
+	})
+}
+
+// indexExpiries adds the keys with a TTL written before the expiry index
+// existed to it, once per store.
+func indexExpiries(db *bbolt.DB) error {
+	var indexed bool
+	err := db.View(func(tx *bbolt.Tx) error {
+		root := systemBucket(tx, expiryBucket)
+		indexed = root != nil && root.Get(expiryIndexedKey) != nil
+		return nil
+	})
+	if err != nil || indexed {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		root, err := createSystemBucket(tx, expiryBucket)
+		if err != nil {
+			return err
+		}
+		if root.Get(expiryIndexedKey) != nil {
+			return nil
+		}
+		err = walkBuckets(tx, func(path [][]byte, bucket *bbolt.Bucket) error {
+			return indexBucketExpiries(tx, path, bucket)
+		})
+		if err != nil {
+			return err
+		}
+		return root.Put(expiryIndexedKey, []byte{1})
+	})
+}
@@ -0,0 +1,552 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Secondary indexes live in the reserved bucket, so they are written in
+// the same transaction as the values they index:
+//
+//	indexes/<bucket path>/defs/<field>                       index definition
+//	indexes/<bucket path>/entries/<field>/<value><key> = key
+//
+// Entry keys start with the order-preserving encoding of the indexed
+// value, so equality and range lookups are prefix and range walks.
+const (
+	indexesBucket = "indexes"
+	indexDefs     = "defs"
+	indexEntries  = "entries"
+)
+
+// Type tags of encoded index values, in the order values sort.
+const (
+	indexNull byte = iota + 1
+	indexBool
+	indexNumber
+	indexString
+)
+
+var (
+	errIndexNotFound = errors.New("index not found")
+	errIndexField    = errors.New("index field must be a non-empty JSON pointer")
+	errNotUnique     = errors.New("unique constraint violated")
+)
+
+// indexDef describes an index on one JSON field of a bucket. A unique
+// index also rejects writes that would give two keys the same value.
+type indexDef struct {
+	Field  string `json:"field"`
+	Unique bool   `json:"unique,omitempty"`
+	// Entries is only reported by the endpoints, never stored.
+	Entries int `json:"entries,omitempty"`
+}
+
+// index is a definition loaded for maintenance or lookups.
+type index struct {
+	def     indexDef
+	tokens  []string
+	entries *bbolt.Bucket
+}
+
+// loadIndexes returns the indexes of the bucket at path, or nil when it
+// has none.
+func loadIndexes(tx *bbolt.Tx, path [][]byte) ([]*index, error) {
+	root := systemBucket(tx, indexesBucket, pathKey(path))
+	if root == nil {
+		return nil, nil
+	}
+	defs, entries := root.Bucket([]byte(indexDefs)), root.Bucket([]byte(indexEntries))
+	if defs == nil || entries == nil {
+		return nil, nil
+	}
+	var indexes []*index
+	err := defs.ForEach(func(field, data []byte) error {
+		idx := &index{entries: entries.Bucket(field)}
+		if err := json.Unmarshal(data, &idx.def); err != nil {
+			return err
+		}
+		tokens, err := parsePointer(idx.def.Field)
+		if err != nil {
+			return err
+		}
+		idx.tokens = tokens
+		indexes = append(indexes, idx)
+		return nil
+	})
+	return indexes, err
+}
+
+// updateIndexes replaces the index entries of key with those of rec, or
+// removes them when rec is nil. It must run before the value is written,
+// since it reads the previous value from bucket.
+func updateIndexes(bucket *bbolt.Bucket, path [][]byte, key []byte, rec *record) error {
+	indexes, err := loadIndexes(bucket.Tx(), path)
+	if err != nil || indexes == nil {
+		return err
+	}
+	var previous *record
+	if data := bucket.Get(key); data != nil {
+		if previous, err = decodeRecord(data); err != nil {
+			return err
+		}
+	}
+	oldDoc, err := indexedDoc(previous)
+	if err != nil {
+		return err
+	}
+	newDoc, err := indexedDoc(rec)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if _, value, ok := idx.value(oldDoc); ok {
+			if err := idx.entries.Delete(indexEntry(value, key)); err != nil {
+				return err
+			}
+		}
+		if field, value, ok := idx.value(newDoc); ok {
+			if err := idx.put(bucket, field, value, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// put adds the entry of key for field, whose encoding is value, after
+// checking a unique index for another key with the same value.
+func (idx *index) put(bucket *bbolt.Bucket, field interface{}, value, key []byte) error {
+	if idx.def.Unique {
+		if err := idx.checkUnique(bucket, field, value, key); err != nil {
+			return err
+		}
+	}
+	return idx.entries.Put(indexEntry(value, key), key)
+}
+
+// checkUnique fails when a key other than key has the same value. The
+// entries of expired keys remain until they are swept, and distinct
+// numbers beyond float64 precision can share an encoding, so the stored
+// value of every colliding key is read back before reporting it.
+func (idx *index) checkUnique(bucket *bbolt.Bucket, field interface{}, value, key []byte) error {
+	c := idx.entries.Cursor()
+	for k, other := c.Seek(value); k != nil && bytes.HasPrefix(k, value); k, other = c.Next() {
+		if bytes.Equal(other, key) {
+			continue
+		}
+		rec, err := getRecord(bucket, other)
+		if err != nil {
+			return err
+		}
+		doc, err := indexedDoc(rec)
+		if err != nil {
+			return err
+		}
+		if current, ok := pointerGet(doc, idx.tokens); !ok || !jsonValuesEqual(current, field) {
+			continue
+		}
+		return fmt.Errorf("%w: %s is already used by key %s", errNotUnique, idx.def.Field, other)
+	}
+	return nil
+}
+
+// indexedDoc decodes the JSON value of rec. Missing and non-JSON values
+// are not indexed and yield nil.
+func indexedDoc(rec *record) (interface{}, error) {
+	if rec == nil || rec.ContentType != "" {
+		return nil, nil
+	}
+	return decodeJSON(rec.Value)
+}
+
+// value returns the indexed field of doc and its encoding. Missing
+// fields, objects and arrays are not indexed.
+func (idx *index) value(doc interface{}) (interface{}, []byte, bool) {
+	if doc == nil {
+		return nil, nil, false
+	}
+	field, ok := pointerGet(doc, idx.tokens)
+	if !ok {
+		return nil, nil, false
+	}
+	value, ok := encodeIndexValue(field)
+	return field, value, ok
+}
+
+// rebuild drops every entry of idx and indexes the current values of bucket.
+func (idx *index) rebuild(root, bucket *bbolt.Bucket) error {
+	entries := root.Bucket([]byte(indexEntries))
+	field := []byte(idx.def.Field)
+	if entries.Bucket(field) != nil {
+		if err := entries.DeleteBucket(field); err != nil {
+			return err
+		}
+	}
+	var err error
+	if idx.entries, err = entries.CreateBucket(field); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	idx.def.Entries = 0
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		rec, err := decodeRecord(v)
+		if err != nil || rec.expired(now) {
+			return err
+		}
+		doc, err := indexedDoc(rec)
+		if err != nil {
+			return err
+		}
+		field, value, ok := idx.value(doc)
+		if !ok {
+			return nil
+		}
+		idx.def.Entries++
+		return idx.put(bucket, field, value, k)
+	})
+}
+
+func indexEntry(value, key []byte) []byte {
+	return append(append(make([]byte, 0, len(value)+len(key)), value...), key...)
+}
+
+// encodeIndexValue encodes a JSON scalar so that byte order matches the
+// order compareValues defines within each type. Strings are escaped and
+// terminated so an entry's value part never runs into its key.
+func encodeIndexValue(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{indexNull}, true
+	case bool:
+		if v {
+			return []byte{indexBool, 1}, true
+		}
+		return []byte{indexBool, 0}, true
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, false
+		}
+		if f == 0 {
+			f = 0 // Normalize -0.
+		}
+		bits := math.Float64bits(f)
+		if bits>>63 == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		buf := []byte{indexNumber, 0, 0, 0, 0, 0, 0, 0, 0}
+		for i := 0; i < 8; i++ {
+			buf[8-i] = byte(bits >> (8 * i))
+		}
+		return buf, true
+	case string:
+		buf := make([]byte, 0, len(v)+3)
+		buf = append(buf, indexString)
+		for i := 0; i < len(v); i++ {
+			buf = append(buf, v[i])
+			if v[i] == 0 {
+				buf = append(buf, 0xff)
+			}
+		}
+		return append(buf, 0, 1), true
+	}
+	return nil, false
+}
+
+// indexPlan is a set of key ranges of one index that together hold every
+// key a predicate can match.
+type indexPlan struct {
+	idx    *index
+	ranges [][2][]byte
+}
+
+// planIndex picks an index that can answer the filter, either a predicate
+// on its own or one of the predicates of a top-level "and". It returns nil
+// when the bucket has to be scanned.
+func planIndex(filter *predicate, indexes []*index) *indexPlan {
+	if filter == nil || indexes == nil {
+		return nil
+	}
+	candidates := []*predicate{filter}
+	if filter.and != nil {
+		candidates = filter.and
+	}
+	for _, p := range candidates {
+		for _, idx := range indexes {
+			if p.field != idx.def.Field {
+				continue
+			}
+			if ranges, ok := p.indexRanges(); ok {
+				return &indexPlan{idx: idx, ranges: ranges}
+			}
+		}
+	}
+	return nil
+}
+
+// indexRanges returns the ranges [from, to) of encoded values that hold
+// every value p can match. Bounds are inclusive of equal values even for
+// strict comparisons, since numbers beyond float64 precision can share an
+// encoding; matches are re-checked against the filter anyway.
+func (p *predicate) indexRanges() ([][2][]byte, bool) {
+	var ranges [][2][]byte
+	switch p.op {
+	case "eq", "in":
+		for _, value := range p.values {
+			enc, ok := encodeIndexValue(value)
+			if !ok {
+				return nil, false
+			}
+			ranges = append(ranges, [2][]byte{enc, prefixSuccessor(enc)})
+		}
+	case "gt", "gte":
+		enc, ok := encodeIndexValue(p.values[0])
+		if !ok {
+			return nil, false
+		}
+		ranges = append(ranges, [2][]byte{enc, {enc[0] + 1}})
+	case "lt", "lte":
+		enc, ok := encodeIndexValue(p.values[0])
+		if !ok {
+			return nil, false
+		}
+		ranges = append(ranges, [2][]byte{{enc[0]}, prefixSuccessor(enc)})
+	default:
+		return nil, false
+	}
+	return ranges, true
+}
+
+// keys returns the distinct keys of the plan's ranges that start with
+// prefix, in key order.
+func (plan *indexPlan) keys(prefix []byte) [][]byte {
+	seen := make(map[string]bool)
+	var keys [][]byte
+	c := plan.idx.entries.Cursor()
+	for _, r := range plan.ranges {
+		for k, key := c.Seek(r[0]); k != nil && bytes.Compare(k, r[1]) < 0; k, key = c.Next() {
+			if !bytes.HasPrefix(key, prefix) || seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+type indexRequest struct {
+	Field  string `json:"field"`
+	Unique bool   `json:"unique"`
+}
+
+// createIndex declares an index on a JSON field of the bucket and builds
+// it from the values already stored, in one transaction. Declaring a
+// unique index fails when stored values already collide.
+func createIndex(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, path, true) {
+		return
+	}
+	var req indexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tokens, err := parsePointer(req.Field); err != nil || len(tokens) == 0 {
+		http.Error(w, errIndexField.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	idx := &index{def: indexDef{Field: req.Field, Unique: req.Unique}}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		root, err := createSystemBucket(tx, indexesBucket, pathKey(path))
+		if err != nil {
+			return err
+		}
+		defs, err := root.CreateBucketIfNotExists([]byte(indexDefs))
+		if err != nil {
+			return err
+		}
+		if _, err := root.CreateBucketIfNotExists([]byte(indexEntries)); err != nil {
+			return err
+		}
+		data, err := json.Marshal(indexDef{Field: req.Field, Unique: req.Unique})
+		if err != nil {
+			return err
+		}
+		if err := defs.Put([]byte(req.Field), data); err != nil {
+			return err
+		}
+		idx.tokens, _ = parsePointer(req.Field)
+		return idx.rebuild(root, bucket)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(idx.def)
+}
+
+func listIndexes(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	defs := []indexDef{}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if getBucket(tx, path) == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		indexes, err := loadIndexes(tx, path)
+		for _, idx := range indexes {
+			idx.def.Entries = idx.entries.Stats().KeyN
+			defs = append(defs, idx.def)
+		}
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]indexDef{"indexes": defs})
+}
+
+// dropIndex removes the index on the field given in the field query parameter.
+func dropIndex(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	field := r.URL.Query().Get("field")
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		defs := systemBucket(tx, indexesBucket, pathKey(path), indexDefs)
+		if defs == nil || defs.Get([]byte(field)) == nil {
+			return errIndexNotFound
+		}
+		if err := defs.Delete([]byte(field)); err != nil {
+			return err
+		}
+		return systemBucket(tx, indexesBucket, pathKey(path), indexEntries).DeleteBucket([]byte(field))
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// rebuildIndexes rebuilds the indexes of the bucket from its current
+// values, all of them or only the one on the field given in the body.
+func rebuildIndexes(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, path, true) {
+		return
+	}
+	var req indexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	defs := []indexDef{}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		indexes, err := loadIndexes(tx, path)
+		if err != nil {
+			return err
+		}
+		root := systemBucket(tx, indexesBucket, pathKey(path))
+		for _, idx := range indexes {
+			if req.Field != "" && idx.def.Field != req.Field {
+				continue
+			}
+			if err := idx.rebuild(root, bucket); err != nil {
+				return err
+			}
+			defs = append(defs, idx.def)
+		}
+		if req.Field != "" && len(defs) == 0 {
+			return errIndexNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]indexDef{"indexes": defs})
+}
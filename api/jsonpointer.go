@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidPointer = errors.New("invalid JSON pointer")
+	errPathNotFound   = errors.New("path not found")
+
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// parsePointer splits an RFC 6901 JSON Pointer ("/profile/email") into
+// its unescaped reference tokens. The empty pointer refers to the whole
+// document and yields no tokens.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, errInvalidPointer
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = pointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerGet returns the value tokens refer to inside doc.
+func pointerGet(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			doc = child
+		case []interface{}:
+			i, ok := arrayIndex(token, len(node))
+			if !ok {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// pointerSet replaces the value tokens refer to inside doc and returns the
+// updated document. Missing objects along the way are created, so setting
+// /stats/visits on {} yields {"stats": {"visits": value}}.
+func pointerSet(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch node := doc.(type) {
+	case nil:
+		child, err := pointerSet(nil, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{token: child}, nil
+	case map[string]interface{}:
+		child, err := pointerSet(node[token], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		i, ok := arrayIndex(token, len(node))
+		if !ok {
+			return nil, errPathNotFound
+		}
+		child, err := pointerSet(node[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	default:
+		return nil, errPathNotFound
+	}
+}
+
+// selectSubtree returns the value tokens refer to inside the JSON
+// document data, as the bytes it is stored with.
+func selectSubtree(data []byte, tokens []string) ([]byte, error) {
+	raw := json.RawMessage(bytes.TrimSpace(data))
+	for _, token := range tokens {
+		switch {
+		case len(raw) > 0 && raw[0] == '{':
+			var node map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &node); err != nil {
+				return nil, err
+			}
+			child, ok := node[token]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			raw = child
+		case len(raw) > 0 && raw[0] == '[':
+			var node []json.RawMessage
+			if err := json.Unmarshal(raw, &node); err != nil {
+				return nil, err
+			}
+			i, ok := arrayIndex(token, len(node))
+			if !ok {
+				return nil, errPathNotFound
+			}
+			raw = node[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return raw, nil
+}
+
+// arrayIndex parses an array reference token and checks it against length.
+func arrayIndex(token string, length int) (int, bool) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= length {
+		return 0, false
+	}
+	return i, true
+}
+
+// decodeJSON parses a JSON document keeping numbers as json.Number, so
+// large integers survive a decode/encode round trip unchanged.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes a document decoded by decodeJSON. Object keys come
+// out sorted, but unlike json.Marshal it leaves <, > and & unescaped.
+func encodeJSON(doc interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+// keysBucket holds the additional API keys of a store, keyed by their
+// SHA-256 like tokens. It lives inside the reserved bucket.
+const keysBucket = "keys"
+
+// defaultKeyGrace is how long the previous key keeps working after a
+// rotation when no grace period is given.
+const defaultKeyGrace = 24 * time.Hour
+
+var (
+	errApiKeyNotFound = errors.New("API key not found")
+	errPrimaryKey     = errors.New("the primary key cannot be revoked, rotate it instead")
+)
+
+// ApiKey describes a key with full access to a store. The primary key is
+// the one the store file is named after; the others are kept in the store.
+type ApiKey struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	// Created and ExpiresAt are Unix milliseconds; zero means no expiry.
+	Created   int64 `json:"created,omitempty"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+func (k *ApiKey) expired(now time.Time) bool {
+	return k.ExpiresAt != 0 && k.ExpiresAt <= now.UnixMilli()
+}
+
+// lookupApiKey reports whether apiKey is a live additional key of the store.
+func lookupApiKey(tx *bbolt.Tx, apiKey string) (bool, error) {
+	keys := systemBucket(tx, keysBucket)
+	if keys == nil {
+		return false, nil
+	}
+	data := keys.Get([]byte(tokenID(apiKey)))
+	if data == nil {
+		return false, nil
+	}
+	var key ApiKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return false, err
+	}
+	return !key.expired(time.Now()), nil
+}
+
+// putApiKey stores an additional key and drops the expired ones.
+func putApiKey(tx *bbolt.Tx, key *ApiKey) error {
+	keys, err := createSystemBucket(tx, keysBucket)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var expired [][]byte
+	err = keys.ForEach(func(id, data []byte) error {
+		var k ApiKey
+		if err := json.Unmarshal(data, &k); err != nil {
+			return err
+		}
+		if k.expired(now) {
+			expired = append(expired, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if err := keys.Delete(id); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return keys.Put([]byte(key.ID), data)
+}
+
+// RotateApiKey gives the store at path a new primary key and returns it.
+// The previous key keeps working for grace, or stops at once when grace
+// is zero.
+func RotateApiKey(path string, grace time.Duration) (string, error) {
+	oldKey := strings.TrimSuffix(filepath.Base(path), ".db")
+	m := apiKeyPattern.FindStringSubmatch(oldKey)
+	if m == nil {
+		return "", errInvalidApiKey
+	}
+	newKey, err := newSecret(m[1])
+	if err != nil {
+		return "", err
+	}
+
+	// Without a grace period an entry left for the key by an earlier
+	// rotation is dropped, so the key stops working with the rename.
+	previous := &ApiKey{ID: tokenID(oldKey), Name: "previous primary key"}
+	err = updateApiKeys(path, func(tx *bbolt.Tx) error {
+		if grace > 0 {
+			previous.ExpiresAt = time.Now().Add(grace).UnixMilli()
+			return putApiKey(tx, previous)
+		}
+		return deleteApiKey(tx, previous.ID)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := RenameStore(path, filepath.Join(filepath.Dir(path), newKey+".db")); err != nil {
+		// The key is still the primary one: its entry would outlive a
+		// later rotation. RevokeApiKey refuses the primary key, so the
+		// entry is deleted directly.
+		cleanup := updateApiKeys(path, func(tx *bbolt.Tx) error {
+			return deleteApiKey(tx, previous.ID)
+		})
+		if cleanup != nil && !os.IsNotExist(cleanup) {
+			return "", errors.Join(err, cleanup)
+		}
+		return "", err
+	}
+	return newKey, nil
+}
+
+// updateApiKeys runs fn in a write transaction on the store at path. The
+// handle is released when it returns, so a rename can follow.
+func updateApiKeys(path string, fn func(tx *bbolt.Tx) error) error {
+	db, release, err := pool.acquire(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.Update(fn)
+}
+
+// deleteApiKey deletes the entry of an additional key, if any.
+func deleteApiKey(tx *bbolt.Tx, id string) error {
+	keys := systemBucket(tx, keysBucket)
+	if keys == nil {
+		return nil
+	}
+	return keys.Delete([]byte(id))
+}
+
+// ListApiKeys returns the primary key of the store at path followed by
+// its additional keys.
+func ListApiKeys(path string) ([]ApiKey, error) {
+	primary := strings.TrimSuffix(filepath.Base(path), ".db")
+	list := []ApiKey{{ID: tokenID(primary), Primary: true}}
+
+	db, release, err := pool.acquire(path)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		keys := systemBucket(tx, keysBucket)
+		if keys == nil {
+			return nil
+		}
+		return keys.ForEach(func(_, data []byte) error {
+			var key ApiKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+			list = append(list, key)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// RevokeApiKey deletes an additional key of the store at path, which stops
+// working immediately.
+func RevokeApiKey(path, id string) error {
+	if id == tokenID(strings.TrimSuffix(filepath.Base(path), ".db")) {
+		return errPrimaryKey
+	}
+
+	db, release, err := pool.acquire(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		keys := systemBucket(tx, keysBucket)
+		if keys == nil || keys.Get([]byte(id)) == nil {
+			return errApiKeyNotFound
+		}
+		return keys.Delete([]byte(id))
+	})
+}
+
+// apiKeyRequest is the body of POST /_keys.
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	TTL  string `json:"ttl"`
+}
+
+// createApiKey issues an additional key with full access to the store.
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	key := &ApiKey{Name: req.Name, Created: now.UnixMilli()}
+	if req.TTL != "" {
+		ttl, err := parseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+
+	t, _ := tenantFromRequest(r)
+	secret, err := newSecret(t.id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key.ID = tokenID(secret)
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return putApiKey(tx, key)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Key string `json:"key"`
+		*ApiKey
+	}{secret, key})
+}
+
+// rotateRequest is the body of POST /_keys/_rotate. Grace is a duration,
+// "0" to revoke the previous key at once; it defaults to defaultKeyGrace.
+type rotateRequest struct {
+	Grace string `json:"grace"`
+}
+
+// rotateApiKey replaces the primary key of the store. The previous key
+// keeps working during the grace period so clients can be redeployed.
+func rotateApiKey(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	var req rotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grace := defaultKeyGrace
+	switch req.Grace {
+	case "":
+	case "0":
+		grace = 0
+	default:
+		var err error
+		if grace, err = parseDuration(req.Grace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, _ := tenantFromRequest(r)
+	key, err := RotateApiKey(t.path, grace)
+	if os.IsNotExist(err) {
+		// Another rotation renamed the store first.
+		http.Error(w, errInvalidApiKey.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"key": key, "id": tokenID(key)}
+	if grace > 0 {
+		resp["previous_expires_at"] = time.Now().Add(grace).UnixMilli()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func listApiKeys(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	t, _ := tenantFromRequest(r)
+	list, err := ListApiKeys(t.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]ApiKey{"keys": list})
+}
+
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	t, _ := tenantFromRequest(r)
+	if err := RevokeApiKey(t.path, mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strconv"
+
+	"go.etcd.io/bbolt"
+)
+
+var errInvalidLimit = errors.New("limit must be a positive integer")
+
+// keyRange selects an ordered slice of a bucket. It is parsed from the
+// query string shared by every endpoint that walks a bucket:
+//
+//	prefix   only keys starting with prefix
+//	start    first key to include (inclusive)
+//	end      key to stop at (exclusive)
+//	after    cursor, continue after this key (the previous page's "next")
+//	reverse  walk keys in descending order
+//	limit    maximum number of entries to return
+type keyRange struct {
+	prefix  []byte
+	start   []byte
+	end     []byte
+	after   []byte
+	reverse bool
+	limit   int
+}
+
+func parseKeyRange(q url.Values) (*keyRange, error) {
+	kr := &keyRange{}
+	if v := q.Get("prefix"); v != "" {
+		kr.prefix = []byte(v)
+	}
+	if v := q.Get("start"); v != "" {
+		kr.start = []byte(v)
+	}
+	if v := q.Get("end"); v != "" {
+		kr.end = []byte(v)
+	}
+	if v := q.Get("after"); v != "" {
+		kr.after = []byte(v)
+	}
+	if v := q.Get("reverse"); v != "" {
+		reverse, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		kr.reverse = reverse
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, errInvalidLimit
+		}
+		kr.limit = limit
+	}
+	return kr, nil
+}
+
+// each calls fn for every entry of the range in order, using Cursor.Seek
+// to jump straight to the first one. fn reports whether the entry counts
+// towards the limit, so callers can skip expired keys or child buckets.
+// When the limit cuts the walk short, each returns the cursor for the
+// next page.
+func (kr *keyRange) each(c *bbolt.Cursor, fn func(k, v []byte) (bool, error)) ([]byte, error) {
+	var k, v []byte
+	var next func() ([]byte, []byte)
+	if kr.reverse {
+		k, v = kr.seekLast(c)
+		next = c.Prev
+	} else {
+		k, v = kr.seekFirst(c)
+		next = c.Next
+	}
+
+	count := 0
+	var last []byte
+	for ; k != nil && kr.contains(k); k, v = next() {
+		if kr.limit > 0 && count == kr.limit {
+			return append([]byte(nil), last...), nil
+		}
+		counted, err := fn(k, v)
+		if err != nil {
+			return nil, err
+		}
+		if counted {
+			count++
+			last = k
+		}
+	}
+	return nil, nil
+}
+
+// contains reports whether k, reached by walking in the range's direction,
+// is still inside it. Walking stops at the first key that is not.
+func (kr *keyRange) contains(k []byte) bool {
+	if kr.prefix != nil && !bytes.HasPrefix(k, kr.prefix) {
+		return false
+	}
+	if kr.reverse {
+		return kr.start == nil || bytes.Compare(k, kr.start) >= 0
+	}
+	return kr.end == nil || bytes.Compare(k, kr.end) < 0
+}
+
+func (kr *keyRange) seekFirst(c *bbolt.Cursor) ([]byte, []byte) {
+	lower := maxKey(kr.start, kr.prefix)
+	if kr.after != nil && bytes.Compare(kr.after, lower) >= 0 {
+		k, v := c.Seek(kr.after)
+		if k != nil && bytes.Equal(k, kr.after) {
+			return c.Next()
+		}
+		return k, v
+	}
+	if lower == nil {
+		return c.First()
+	}
+	return c.Seek(lower)
+}
+
+func (kr *keyRange) seekLast(c *bbolt.Cursor) ([]byte, []byte) {
+	// upper is an exclusive bound: the walk starts at the last key below it.
+	var upper []byte
+	for _, bound := range [][]byte{kr.end, kr.after, prefixSuccessor(kr.prefix)} {
+		if bound != nil && (upper == nil || bytes.Compare(bound, upper) < 0) {
+			upper = bound
+		}
+	}
+	if upper == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(upper); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+func maxKey(a, b []byte) []byte {
+	if bytes.Compare(a, b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// prefixSuccessor returns the smallest key greater than every key that
+// starts with prefix, or nil when there is none.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := append([]byte(nil), prefix[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
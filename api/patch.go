@@ -0,0 +1,394 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var (
+	errKeyNotFound      = errors.New("Key not found")
+	errNotJSON          = errors.New("stored value is not JSON")
+	errPatchTestFailed  = errors.New("test operation failed")
+	errPatchCannotApply = errors.New("patch cannot be applied")
+)
+
+// patchOp is one RFC 6902 JSON Patch operation. Value is nil when the
+// member is absent, which is different from an explicit null.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// patchKey applies an RFC 7396 merge patch or an RFC 6902 JSON Patch,
+// selected by Content-Type, to a stored JSON value in one transaction.
+// A failed test operation answers 409, an operation that cannot be
+// applied to the document answers 422, and nothing is written.
+func patchKey(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		http.Error(w, "Content-Type must be "+mergePatchType+" or "+jsonPatchType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var apply func(doc interface{}) (interface{}, error)
+	if mediaType == mergePatchType {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, patch), nil
+		}
+	} else {
+		var ops []patchOp
+		if err := json.Unmarshal(body, &ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return applyJSONPatch(doc, ops)
+		}
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var rec *record
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		current, err := getRecord(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return errKeyNotFound
+		}
+		if err := checkPreconditions(r, current); err != nil {
+			return err
+		}
+		if current.ContentType != "" {
+			return errNotJSON
+		}
+		doc, err := decodeJSON(current.Value)
+		if err != nil {
+			return err
+		}
+		if doc, err = apply(doc); err != nil {
+			return err
+		}
+		rec = &record{ExpiresAt: current.ExpiresAt}
+		if rec.Value, err = encodeJSON(doc); err != nil {
+			return err
+		}
+		return putRecord(bucket, path, []byte(key), rec)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", rec.etag())
+	w.Write(rec.Value)
+}
+
+// mergePatch applies an RFC 7396 merge patch to target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// applyJSONPatch applies RFC 6902 operations to doc in order.
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOp(doc interface{}, op patchOp) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errPatchCannotApply, err)
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: missing value", errPatchCannotApply)
+		}
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %s", errPatchCannotApply, err)
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errPatchCannotApply, err)
+		}
+		var ok bool
+		if value, ok = pointerGet(doc, from); !ok {
+			return nil, fmt.Errorf("%w: from %s not found", errPatchCannotApply, op.From)
+		}
+		if op.Op == "copy" {
+			value = deepCopy(value)
+			break
+		}
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move a value into itself", errPatchCannotApply)
+		}
+		if doc, err = patchRemove(doc, from); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return patchAdd(doc, path, value)
+	case "remove":
+		return patchRemove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if _, ok := pointerGet(doc, path); !ok {
+			return nil, fmt.Errorf("%w: path not found", errPatchCannotApply)
+		}
+		if doc, err = patchRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, path, value)
+	case "test":
+		current, ok := pointerGet(doc, path)
+		if !ok || !jsonValuesEqual(current, value) {
+			return nil, errPatchTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", errPatchCannotApply, op.Op)
+	}
+}
+
+// patchAdd implements the "add" operation: it sets an object member or
+// inserts into an array ("-" appends).
+func patchAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	return updateParent(doc, path, value, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[last] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if last != "-" {
+				var ok bool
+				if i, ok = arrayIndex(last, len(node)+1); !ok {
+					return nil, fmt.Errorf("%w: index %s out of range", errPatchCannotApply, last)
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("%w: parent is not a container", errPatchCannotApply)
+		}
+	})
+}
+
+// patchRemove implements the "remove" operation.
+func patchRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", errPatchCannotApply)
+	}
+	return updateParent(doc, path, nil, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[last]; !ok {
+				return nil, fmt.Errorf("%w: path not found", errPatchCannotApply)
+			}
+			delete(node, last)
+			return node, nil
+		case []interface{}:
+			i, ok := arrayIndex(last, len(node))
+			if !ok {
+				return nil, fmt.Errorf("%w: index %s out of range", errPatchCannotApply, last)
+			}
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%w: path not found", errPatchCannotApply)
+		}
+	})
+}
+
+// updateParent walks to the container holding the last token of path,
+// lets fn modify it and stores the result back into its own parent. An
+// empty path replaces the whole document with root.
+func updateParent(doc interface{}, path []string, root interface{}, fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 0 {
+		return root, nil
+	}
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, ok := pointerGet(doc, path[:1])
+	if !ok {
+		return nil, fmt.Errorf("%w: path not found", errPatchCannotApply)
+	}
+	child, err := updateParent(child, path[1:], root, fn)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(path[0])
+		node[i] = child
+	}
+	return doc, nil
+}
+
+// deepCopy copies a decoded JSON value so a "copy" operation does not
+// alias containers between the source and the target.
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			c[k] = deepCopy(v)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(node))
+		for i, v := range node {
+			c[i] = deepCopy(v)
+		}
+		return c
+	default:
+		return value
+	}
+}
+
+// jsonValuesEqual compares two values decoded by decodeJSON. Numbers that
+// are spelled differently but equal (1 and 1.0) are equal; numbers that
+// only float64 cannot tell apart are not.
+func jsonValuesEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !jsonValuesEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonValuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		c, ok := compareNumbers(av, bv)
+		return ok && c == 0
+	default:
+		return a == b
+	}
+}
+
+// numberPrecision is the mantissa size, in bits, numbers are compared
+// with. It keeps integers of up to 150 digits exact.
+const numberPrecision = 512
+
+// compareNumbers orders two JSON numbers without rounding them to float64.
+func compareNumbers(a, b json.Number) (int, bool) {
+	if a == b {
+		return 0, true
+	}
+	if ai, err := a.Int64(); err == nil {
+		if bi, err := b.Int64(); err == nil {
+			switch {
+			case ai < bi:
+				return -1, true
+			case ai > bi:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	af, _, errA := big.ParseFloat(string(a), 10, numberPrecision, big.ToNearestEven)
+	bf, _, errB := big.ParseFloat(string(b), 10, numberPrecision, big.ToNearestEven)
+	if errA != nil || errB != nil {
+		return 0, false
+	}
+	return af.Cmp(bf), true
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// maxOpenStores caps how many bbolt files the server keeps open at once.
+	maxOpenStores = 256
+	// storeIdleTimeout is how long an unused handle stays open before it is closed.
+	storeIdleTimeout = 5 * time.Minute
+	// storeLockTimeout bounds the wait for bbolt's file lock when opening a store.
+	storeLockTimeout = 5 * time.Second
+)
+
+var pool = newDbPool()
+
+// dbPool shares long-lived bbolt handles between requests. Every handle is
+// reference counted: it is only closed once all users have released it,
+// either because it sat idle for storeIdleTimeout, because room is needed
+// for another store, or because the file is about to be renamed.
+type dbPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	handles  map[string]*pooledDb
+	renaming map[string]bool
+	janitor  sync.Once
+}
+
+type pooledDb struct {
+	db       *bbolt.DB
+	refs     int
+	opening  bool
+	lastUsed time.Time
+}
+
+func newDbPool() *dbPool {
+	p := &dbPool{
+		handles:  make(map[string]*pooledDb),
+		renaming: make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// OpenStore returns a shared handle for the existing bbolt file at path.
+// The handle must not be closed; call the returned release function instead.
+func OpenStore(path string) (*bbolt.DB, func(), error) {
+	return pool.acquire(path)
+}
+
+// RenameStore renames a store file on disk. It waits for every in-flight
+// user of the old file to release its handle, closes it, and keeps new
+// requests for either name waiting until the rename is done.
+func RenameStore(oldPath, newPath string) error {
+	if err := pool.rename(oldPath, newPath); err != nil {
+		return err
+	}
+	stores.forget(oldPath)
+	RegisterStore(newPath)
+	return nil
+}
+
+func (p *dbPool) acquire(path string) (*bbolt.DB, func(), error) {
+	path = poolKey(path)
+	p.janitor.Do(func() { go p.evictIdle() })
+
+	p.mu.Lock()
+	for {
+		if p.renaming[path] {
+			p.cond.Wait()
+			continue
+		}
+		if h, ok := p.handles[path]; ok {
+			if h.opening {
+				p.cond.Wait()
+				continue
+			}
+			h.refs++
+			p.mu.Unlock()
+			return h.db, p.releaser(path, h), nil
+		}
+		if len(p.handles) >= maxOpenStores && !p.evictOldestLocked() {
+			// Every open handle is in use; wait for one to be released.
+			p.cond.Wait()
+			continue
+		}
+		break
+	}
+
+	h := &pooledDb{opening: true, refs: 1}
+	p.handles[path] = h
+	p.mu.Unlock()
+
+	db, err := openExisting(path)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.cond.Broadcast()
+	h.opening = false
+	if err != nil {
+		delete(p.handles, path)
+		return nil, nil, err
+	}
+	h.db = db
+	return db, p.releaser(path, h), nil
+}
+
+func (p *dbPool) releaser(path string, h *pooledDb) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			h.refs--
+			h.lastUsed = time.Now()
+			p.mu.Unlock()
+			p.cond.Broadcast()
+		})
+	}
+}
+
+func (p *dbPool) rename(oldPath, newPath string) error {
+	oldPath, newPath = poolKey(oldPath), poolKey(newPath)
+
+	p.mu.Lock()
+	for p.renaming[oldPath] || p.renaming[newPath] {
+		p.cond.Wait()
+	}
+	p.renaming[oldPath] = true
+	p.renaming[newPath] = true
+	for _, path := range []string{oldPath, newPath} {
+		for {
+			h, ok := p.handles[path]
+			if !ok {
+				break
+			}
+			if h.opening || h.refs > 0 {
+				p.cond.Wait()
+				continue
+			}
+			h.db.Close()
+			delete(p.handles, path)
+		}
+	}
+	p.mu.Unlock()
+
+	err := os.Rename(oldPath, newPath)
+
+	p.mu.Lock()
+	delete(p.renaming, oldPath)
+	delete(p.renaming, newPath)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	return err
+}
+
+// evictOldestLocked closes the least recently used idle handle. It reports
+// false when every handle is still referenced. p.mu must be held.
+func (p *dbPool) evictOldestLocked() bool {
+	var oldestPath string
+	var oldest *pooledDb
+	for path, h := range p.handles {
+		if h.opening || h.refs > 0 {
+			continue
+		}
+		if oldest == nil || h.lastUsed.Before(oldest.lastUsed) {
+			oldestPath, oldest = path, h
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	oldest.db.Close()
+	delete(p.handles, oldestPath)
+	return true
+}
+
+func (p *dbPool) evictIdle() {
+	ticker := time.NewTicker(storeIdleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		for path, h := range p.handles {
+			if !h.opening && h.refs == 0 && time.Since(h.lastUsed) > storeIdleTimeout {
+				h.db.Close()
+				delete(p.handles, path)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// closeAll closes every idle handle. It is used by tests between runs.
+func (p *dbPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.evictOldestLocked() {
+	}
+}
+
+// openExisting opens a bbolt file without ever creating it, so a request
+// racing with a rename cannot leave an empty database behind.
+func openExisting(path string) (*bbolt.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return bbolt.Open(path, 0666, &bbolt.Options{Timeout: storeLockTimeout})
+}
+
+func poolKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
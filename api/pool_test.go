@@ -0,0 +1,130 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func createStoreFile(t *testing.T, path string) {
+	db, err := bbolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	db.Close()
+}
+
+func TestPoolSharesHandles(t *testing.T) {
+	dir := t.TempDir()
+	p := newDbPool()
+	defer p.closeAll()
+
+	path := filepath.Join(dir, "store.db")
+	createStoreFile(t, path)
+
+	db1, release1, err := p.acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire store: %v", err)
+	}
+	db2, release2, err := p.acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire store twice: %v", err)
+	}
+	if db1 != db2 {
+		t.Fatalf("Expected concurrent users to share one handle")
+	}
+	release1()
+	release2()
+
+	if _, _, err := p.acquire(filepath.Join(dir, "missing.db")); err == nil {
+		t.Fatalf("Expected an error for a missing store")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Fatalf("Pool must not create missing stores")
+	}
+}
+
+func TestPoolEvictsIdleHandlesOverCap(t *testing.T) {
+	dir := t.TempDir()
+	p := newDbPool()
+	defer p.closeAll()
+
+	saved := maxOpenStores
+	maxOpenStores = 1
+	defer func() { maxOpenStores = saved }()
+
+	first := filepath.Join(dir, "first.db")
+	second := filepath.Join(dir, "second.db")
+	createStoreFile(t, first)
+	createStoreFile(t, second)
+
+	_, release, err := p.acquire(first)
+	if err != nil {
+		t.Fatalf("Failed to acquire store: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		_, release, err := p.acquire(second)
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Second store opened while the cap was reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("Second store was not opened after the first was released")
+	}
+	if len(p.handles) != 1 {
+		t.Fatalf("Expected 1 open handle, got %d", len(p.handles))
+	}
+}
+
+func TestPoolRenameWaitsForRelease(t *testing.T) {
+	dir := t.TempDir()
+	p := newDbPool()
+	defer p.closeAll()
+
+	oldPath := filepath.Join(dir, "old.db")
+	newPath := filepath.Join(dir, "new.db")
+	createStoreFile(t, oldPath)
+
+	_, release, err := p.acquire(oldPath)
+	if err != nil {
+		t.Fatalf("Failed to acquire store: %v", err)
+	}
+
+	renamed := make(chan error)
+	go func() { renamed <- p.rename(oldPath, newPath) }()
+
+	select {
+	case <-renamed:
+		t.Fatalf("Rename finished while the store was in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if err := <-renamed; err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, _, err := p.acquire(oldPath); err == nil {
+		t.Fatalf("Old store path still opens after rename")
+	}
+	_, release, err = p.acquire(newPath)
+	if err != nil {
+		t.Fatalf("Failed to acquire renamed store: %v", err)
+	}
+	release()
+}
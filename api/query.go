@@ -0,0 +1,457 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// queryRequest is the body of POST /{bucket}/_query.
+//
+// A filter is either a combination ({"and": [...]}, {"or": [...]},
+// {"not": {...}}) or a predicate on the JSON field a JSON Pointer refers
+// to, with exactly one operator:
+//
+//	{"field": "/age", "gte": 18}
+//	{"field": "/status", "in": ["active", "trial"]}
+//	{"field": "/email", "exists": true}
+//
+// Operators are eq, ne, gt, gte, lt, lte, in and exists. Numbers compare
+// numerically and strings lexicographically; values of different types
+// never match a comparison.
+type queryRequest struct {
+	Filter *filterSpec `json:"filter"`
+	Fields []string    `json:"fields"`
+	Sort   []sortSpec  `json:"sort"`
+	Limit  int         `json:"limit"`
+	Prefix string      `json:"prefix"`
+}
+
+type filterSpec struct {
+	And []*filterSpec `json:"and"`
+	Or  []*filterSpec `json:"or"`
+	Not *filterSpec   `json:"not"`
+
+	Field  string            `json:"field"`
+	Eq     json.RawMessage   `json:"eq"`
+	Ne     json.RawMessage   `json:"ne"`
+	Gt     json.RawMessage   `json:"gt"`
+	Gte    json.RawMessage   `json:"gte"`
+	Lt     json.RawMessage   `json:"lt"`
+	Lte    json.RawMessage   `json:"lte"`
+	In     []json.RawMessage `json:"in"`
+	Exists *bool             `json:"exists"`
+}
+
+type sortSpec struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// predicate is a compiled filter.
+type predicate struct {
+	and []*predicate
+	or  []*predicate
+	not *predicate
+
+	field  string
+	tokens []string
+	op     string
+	values []interface{}
+	exists bool
+}
+
+type queryResult struct {
+	key  string
+	rec  *record
+	doc  interface{}
+	sort []interface{}
+}
+
+func queryBucket(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := compileQuery(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var results []*queryResult
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		indexes, err := loadIndexes(tx, path)
+		if err != nil {
+			return err
+		}
+		results, err = q.run(bucket, planIndex(q.filter, indexes))
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Values are returned as stored unless fields project them.
+	items := make([]scanItem, 0, len(results))
+	for _, result := range results {
+		item := scanItem{Key: result.key}
+		item.ETag = result.rec.etag()
+		item.Value = result.rec.Value
+		if q.fields != nil {
+			if item.Value, err = encodeJSON(q.project(result.doc)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		items = append(items, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]interface{}{"items": items, "count": len(items)})
+}
+
+// compiledQuery is a validated queryRequest.
+type compiledQuery struct {
+	filter *predicate
+	fields [][]string
+	sort   [][]string
+	desc   []bool
+	limit  int
+	prefix []byte
+}
+
+func compileQuery(req *queryRequest) (*compiledQuery, error) {
+	q := &compiledQuery{limit: req.Limit}
+	if req.Limit < 0 {
+		return nil, errInvalidLimit
+	}
+	if req.Prefix != "" {
+		q.prefix = []byte(req.Prefix)
+	}
+	if req.Filter != nil {
+		var err error
+		if q.filter, err = compileFilter(req.Filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range req.Fields {
+		tokens, err := parsePointer(field)
+		if err != nil {
+			return nil, err
+		}
+		q.fields = append(q.fields, tokens)
+	}
+	for _, s := range req.Sort {
+		tokens, err := parsePointer(s.Field)
+		if err != nil {
+			return nil, err
+		}
+		q.sort = append(q.sort, tokens)
+		q.desc = append(q.desc, s.Desc)
+	}
+	return q, nil
+}
+
+func compileFilter(spec *filterSpec) (*predicate, error) {
+	p := &predicate{field: spec.Field}
+	kinds := 0
+	for _, sub := range spec.And {
+		c, err := compileFilter(sub)
+		if err != nil {
+			return nil, err
+		}
+		p.and = append(p.and, c)
+	}
+	for _, sub := range spec.Or {
+		c, err := compileFilter(sub)
+		if err != nil {
+			return nil, err
+		}
+		p.or = append(p.or, c)
+	}
+	if spec.And != nil {
+		kinds++
+	}
+	if spec.Or != nil {
+		kinds++
+	}
+	if spec.Not != nil {
+		kinds++
+		var err error
+		if p.not, err = compileFilter(spec.Not); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, op := range []struct {
+		name  string
+		value json.RawMessage
+	}{{"eq", spec.Eq}, {"ne", spec.Ne}, {"gt", spec.Gt}, {"gte", spec.Gte}, {"lt", spec.Lt}, {"lte", spec.Lte}} {
+		if op.value == nil {
+			continue
+		}
+		kinds++
+		value, err := decodeJSON(op.value)
+		if err != nil {
+			return nil, err
+		}
+		p.op, p.values = op.name, []interface{}{value}
+	}
+	if spec.In != nil {
+		kinds++
+		p.op = "in"
+		for _, raw := range spec.In {
+			value, err := decodeJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			p.values = append(p.values, value)
+		}
+	}
+	if spec.Exists != nil {
+		kinds++
+		p.op, p.exists = "exists", *spec.Exists
+	}
+
+	if kinds != 1 {
+		return nil, fmt.Errorf("%w: every filter needs exactly one of and, or, not or an operator", errInvalidFilter)
+	}
+	if (spec.And != nil && len(spec.And) == 0) || (spec.Or != nil && len(spec.Or) == 0) {
+		return nil, fmt.Errorf("%w: and and or need at least one filter", errInvalidFilter)
+	}
+	if p.op != "" {
+		tokens, err := parsePointer(spec.Field)
+		if err != nil || spec.Field == "" {
+			return nil, fmt.Errorf("%w: operator filters need a JSON Pointer field", errInvalidFilter)
+		}
+		p.tokens = tokens
+	}
+	return p, nil
+}
+
+// run walks the bucket (or the keys under the query prefix), keeping the
+// values that match the filter. When plan is set, only the keys the index
+// returns are read. Without sorting it stops at the limit.
+func (q *compiledQuery) run(bucket *bbolt.Bucket, plan *indexPlan) ([]*queryResult, error) {
+	limit := q.limit
+	if q.sort != nil {
+		limit = 0
+	}
+	now := time.Now()
+	var results []*queryResult
+	visit := func(k, v []byte) (bool, error) {
+		if v == nil {
+			return false, nil
+		}
+		rec, err := decodeRecord(v)
+		if err != nil {
+			return false, err
+		}
+		result, err := q.match(k, rec, now)
+		if err != nil || result == nil {
+			return false, err
+		}
+		results = append(results, result)
+		return true, nil
+	}
+
+	if plan != nil {
+		for _, k := range plan.keys(q.prefix) {
+			if limit > 0 && len(results) == limit {
+				break
+			}
+			if _, err := visit(k, bucket.Get(k)); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		kr := &keyRange{prefix: q.prefix, limit: limit}
+		if _, err := kr.each(bucket.Cursor(), visit); err != nil {
+			return nil, err
+		}
+	}
+
+	q.sortResults(results)
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[:q.limit]
+	}
+	return results, nil
+}
+
+// match decodes rec and tests it against the filter. It returns nil for
+// values that do not match, are expired or are not JSON.
+func (q *compiledQuery) match(k []byte, rec *record, now time.Time) (*queryResult, error) {
+	if rec.expired(now) || rec.ContentType != "" {
+		return nil, nil
+	}
+	doc, err := decodeJSON(rec.Value)
+	if err != nil {
+		return nil, err
+	}
+	if q.filter != nil && !q.filter.match(doc) {
+		return nil, nil
+	}
+	result := &queryResult{key: string(k), rec: rec.clone(), doc: doc}
+	for _, tokens := range q.sort {
+		value, _ := pointerGet(doc, tokens)
+		result.sort = append(result.sort, value)
+	}
+	return result, nil
+}
+
+func (q *compiledQuery) sortResults(results []*queryResult) {
+	if q.sort == nil {
+		return
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		for n := range q.sort {
+			a, b := results[i].sort[n], results[j].sort[n]
+			// Missing fields sort last in both directions.
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				continue
+			}
+			c, ok := compareValues(a, b)
+			if !ok || c == 0 {
+				continue
+			}
+			return (c < 0) != q.desc[n]
+		}
+		return false
+	})
+}
+
+// project keeps only the requested fields of doc, or returns doc as is
+// when no fields were requested.
+func (q *compiledQuery) project(doc interface{}) interface{} {
+	if q.fields == nil {
+		return doc
+	}
+	projected := interface{}(map[string]interface{}{})
+	for _, tokens := range q.fields {
+		if value, ok := pointerGet(doc, tokens); ok {
+			projected, _ = pointerSet(projected, tokens, value)
+		}
+	}
+	return projected
+}
+
+func (p *predicate) match(doc interface{}) bool {
+	switch {
+	case p.and != nil:
+		for _, sub := range p.and {
+			if !sub.match(doc) {
+				return false
+			}
+		}
+		return true
+	case p.or != nil:
+		for _, sub := range p.or {
+			if sub.match(doc) {
+				return true
+			}
+		}
+		return false
+	case p.not != nil:
+		return !p.not.match(doc)
+	}
+
+	value, ok := pointerGet(doc, p.tokens)
+	switch p.op {
+	case "exists":
+		return ok == p.exists
+	case "in":
+		for _, candidate := range p.values {
+			if ok && jsonValuesEqual(value, candidate) {
+				return true
+			}
+		}
+		return false
+	case "eq":
+		return ok && jsonValuesEqual(value, p.values[0])
+	case "ne":
+		return !ok || !jsonValuesEqual(value, p.values[0])
+	}
+	if !ok {
+		return false
+	}
+	c, comparable := compareValues(value, p.values[0])
+	if !comparable {
+		return false
+	}
+	switch p.op {
+	case "gt":
+		return c > 0
+	case "gte":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "lte":
+		return c <= 0
+	}
+	return false
+}
+
+// compareValues orders two decoded JSON scalars of the same type. It
+// reports false when they cannot be ordered against each other.
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		return compareNumbers(av, bv)
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare([]byte(av), []byte(bv)), true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av == bv:
+			return 0, true
+		case !av:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
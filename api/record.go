@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const defaultContentType = "application/json"
+
+// recordMagic starts every stored value that carries metadata. A JSON
+// document can never begin with a NUL byte, so values without it are
+// plain JSON written before metadata existed (or that never needed any).
+const recordMagic = 0x00
+
+var (
+	errCorruptRecord = errors.New("corrupt stored value")
+	errInvalidTTL    = errors.New("TTL must be a positive number of seconds or a duration like 10m")
+)
+
+// record is a stored value together with its metadata.
+type record struct {
+	ContentType string `json:"ct,omitempty"`
+	// ExpiresAt is the expiry time in Unix milliseconds, zero for no expiry.
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Value     []byte `json:"-"`
+}
+
+// hasMetadata reports whether rec needs the metadata header to be stored.
+func (rec *record) hasMetadata() bool {
+	return rec.ContentType != "" || rec.ExpiresAt != 0
+}
+
+// expired reports whether rec has a TTL that ran out before now.
+func (rec *record) expired(now time.Time) bool {
+	return rec.ExpiresAt != 0 && rec.ExpiresAt <= now.UnixMilli()
+}
+
+// contentType returns the media type the value is served with.
+func (rec *record) contentType() string {
+	if rec.ContentType == "" {
+		return defaultContentType
+	}
+	return rec.ContentType
+}
+
+// clone copies rec out of bbolt-owned memory so it outlives the transaction.
+func (rec *record) clone() *record {
+	c := *rec
+	c.Value = append([]byte(nil), rec.Value...)
+	return &c
+}
+
+// etag returns a strong entity tag derived from the value and its media type.
+func (rec *record) etag() string {
+	h := sha256.New()
+	h.Write([]byte(rec.contentType()))
+	h.Write([]byte{0})
+	h.Write(rec.Value)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// encodeRecord serializes rec for storage. JSON values without metadata
+// are stored as-is so store files stay readable as plain JSON.
+func encodeRecord(rec *record) ([]byte, error) {
+	if !rec.hasMetadata() {
+		return rec.Value, nil
+	}
+	header, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64+len(header)+len(rec.Value))
+	buf[0] = recordMagic
+	buf = binary.AppendUvarint(buf, uint64(len(header)))
+	buf = append(buf, header...)
+	return append(buf, rec.Value...), nil
+}
+
+// decodeRecord parses a stored value. The returned record references
+// data, so it is only valid for the lifetime of the transaction.
+func decodeRecord(data []byte) (*record, error) {
+	if len(data) == 0 || data[0] != recordMagic {
+		return &record{Value: data}, nil
+	}
+	n, size := binary.Uvarint(data[1:])
+	if size <= 0 || uint64(len(data)-1-size) < n {
+		return nil, errCorruptRecord
+	}
+	header := data[1+size : 1+size+int(n)]
+	rec := &record{}
+	if err := json.Unmarshal(header, rec); err != nil {
+		return nil, errCorruptRecord
+	}
+	rec.Value = data[1+size+int(n):]
+	return rec, nil
+}
+
+// getRecord reads and decodes key from bucket. It returns nil when the
+// key does not exist or has expired.
+func getRecord(bucket *bbolt.Bucket, key []byte) (*record, error) {
+	data := bucket.Get(key)
+	if data == nil {
+		return nil, nil
+	}
+	rec, err := decodeRecord(data)
+	if err != nil || rec.expired(time.Now()) {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// putRecord encodes rec and stores it under key in bucket, which lives at
+// path. Every write goes through putRecord or deleteRecord, which validate
+// values against the bucket schema, keep the bucket's indexes, the expiry
+// index and the last-modified time up to date in the same transaction,
+// and publish the change to the bucket's change feed once it commits.
+func putRecord(bucket *bbolt.Bucket, path [][]byte, key []byte, rec *record) error {
+	if err := checkName(key); err != nil {
+		return err
+	}
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if err := validateRecord(bucket.Tx(), path, rec); err != nil {
+		return err
+	}
+	if err := updateIndexes(bucket, path, key, rec); err != nil {
+		return err
+	}
+	if err := updateExpiry(bucket, path, key, rec); err != nil {
+		return err
+	}
+	if err := bucket.Put(key, data); err != nil {
+		return err
+	}
+	if err := publishChange(bucket.Tx(), path, key, rec); err != nil {
+		return err
+	}
+	return touchBucket(bucket.Tx(), path)
+}
+
+// deleteRecord removes key from bucket, which lives at path.
+func deleteRecord(bucket *bbolt.Bucket, path [][]byte, key []byte) error {
+	if bucket.Get(key) == nil {
+		return nil
+	}
+	if err := updateIndexes(bucket, path, key, nil); err != nil {
+		return err
+	}
+	if err := updateExpiry(bucket, path, key, nil); err != nil {
+		return err
+	}
+	if err := bucket.Delete(key); err != nil {
+		return err
+	}
+	if err := publishChange(bucket.Tx(), path, key, nil); err != nil {
+		return err
+	}
+	return touchBucket(bucket.Tx(), path)
+}
+
+// isExpired reports whether the stored value data has a TTL that ran out
+// before now. Plain JSON values never expire, so they are not decoded.
+func isExpired(data []byte, now time.Time) bool {
+	if len(data) == 0 || data[0] != recordMagic {
+		return false
+	}
+	rec, err := decodeRecord(data)
+	return err == nil && rec.expired(now)
+}
+
+// parseTTL reads a time-to-live from the X-TTL header or the ttl query
+// parameter. It accepts whole seconds ("300") or a Go duration ("5m").
+// The returned expiry is zero when no TTL was requested.
+func parseTTL(r *http.Request, now time.Time) (int64, error) {
+	ttl := r.Header.Get("X-TTL")
+	if ttl == "" {
+		ttl = r.URL.Query().Get("ttl")
+	}
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := parseDuration(ttl)
+	if err != nil {
+		return 0, err
+	}
+	return now.Add(d).UnixMilli(), nil
+}
+
+// parseDuration parses a positive TTL given in whole seconds or as a Go duration.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(s, 10, 64)
+		if convErr != nil {
+			return 0, errInvalidTTL
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		return 0, errInvalidTTL
+	}
+	return d, nil
+}
+
+// parseContentType normalizes a Content-Type request header. JSON (or a
+// missing header) maps to the empty string, which means the default type.
+func parseContentType(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", err
+	}
+	if mediaType == defaultContentType {
+		return "", nil
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	errBucketExists  = errors.New("target bucket already exists")
+	errInvalidTarget = errors.New("target must be a different bucket, neither inside nor above the source")
+)
+
+// bucketCopyRequest is the body of POST /{bucket}/_rename and _copy.
+type bucketCopyRequest struct {
+	// To is the slash-separated path of the target bucket.
+	To string `json:"to"`
+	// Prefix limits the operation to the keys starting with it. Nested
+	// buckets are only carried over when it is empty.
+	Prefix string `json:"prefix"`
+	// Overwrite replaces an existing target bucket instead of failing.
+	Overwrite bool `json:"overwrite"`
+}
+
+// renameBucket moves the bucket, or the keys under a prefix, to another
+// bucket path in one transaction. A full rename carries the bucket's
+// indexes, schema and metadata over to the new path.
+func renameBucket(w http.ResponseWriter, r *http.Request) {
+	transferBucket(w, r, true)
+}
+
+// copyBucket copies the bucket, or the keys under a prefix, to another
+// bucket path in one transaction, together with its indexes and schema.
+func copyBucket(w http.ResponseWriter, r *http.Request) {
+	transferBucket(w, r, false)
+}
+
+func transferBucket(w http.ResponseWriter, r *http.Request, move bool) {
+	from, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req bucketCopyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := splitBucketPath(req.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if string(to[0]) == reservedBucket {
+		http.Error(w, "Bucket name 'system' not allowed", http.StatusBadRequest)
+		return
+	}
+	if isWithin(from, to) || isWithin(to, from) {
+		http.Error(w, errInvalidTarget.Error(), http.StatusBadRequest)
+		return
+	}
+	// Both buckets are written to by a rename, only the target by a copy.
+	if !authorize(w, r, from, move) || !authorize(w, r, to, true) {
+		return
+	}
+	var prefix []byte
+	if req.Prefix != "" {
+		prefix = []byte(req.Prefix)
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var copied int
+	err = db.Update(func(tx *bbolt.Tx) error {
+		src := getBucket(tx, from)
+		if src == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		if getBucket(tx, to) != nil {
+			if !req.Overwrite {
+				return errBucketExists
+			}
+			if err := deleteBucketPath(tx, to); err != nil {
+				return err
+			}
+			if err := dropBucketAreas(tx, to); err != nil {
+				return err
+			}
+			if err := publishReset(tx, to); err != nil {
+				return err
+			}
+		}
+		if err := createUserBucket(tx, to); err != nil {
+			return err
+		}
+		dst := getBucket(tx, to)
+		if copied, err = copyBucketData(src, dst, prefix); err != nil {
+			return err
+		}
+
+		// A full rename keeps the metadata of the moved buckets; anything
+		// else creates new buckets.
+		whole := move && prefix == nil
+		areas := []string{indexesBucket, schemasBucket}
+		if whole {
+			areas = bucketAreas
+		}
+		if err := copyBucketAreas(tx, from, to, areas, prefix == nil); err != nil {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		err := walkNested(to, dst, func(path [][]byte, bucket *bbolt.Bucket) error {
+			if !whole {
+				err := updateBucketMeta(tx, path, func(meta *bucketMeta) {
+					meta.Created, meta.Modified = now, now
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if err := indexBucketExpiries(tx, path, bucket); err != nil {
+				return err
+			}
+			return rebuildBucketIndexes(tx, path, bucket)
+		})
+		if err != nil || !move {
+			return err
+		}
+
+		if whole {
+			if err := deleteBucketPath(tx, from); err != nil {
+				return err
+			}
+			if err := dropBucketAreas(tx, from); err != nil {
+				return err
+			}
+			return publishReset(tx, from)
+		}
+		return deleteKeys(src, from, prefix)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"bucket": req.To, "keys": copied})
+}
+
+// isWithin reports whether path is inner or one of its nested buckets.
+func isWithin(path, inner [][]byte) bool {
+	if len(inner) < len(path) {
+		return false
+	}
+	for i := range path {
+		if !bytes.Equal(path[i], inner[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyBucketData copies the stored values of src under prefix into dst as
+// they are, metadata included, and returns how many it copied. Without a
+// prefix nested buckets are copied too.
+func copyBucketData(src, dst *bbolt.Bucket, prefix []byte) (int, error) {
+	copied := 0
+	c := src.Cursor()
+	k, v := c.First()
+	if prefix != nil {
+		k, v = c.Seek(prefix)
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if v != nil {
+			if err := dst.Put(k, v); err != nil {
+				return copied, err
+			}
+			copied++
+			continue
+		}
+		if prefix != nil {
+			continue
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return copied, err
+		}
+		n, err := copyBucketData(src.Bucket(k), child, nil)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// copyBucketAreas copies what the given areas hold about the bucket at
+// from, and with nested about its nested buckets, to the matching paths
+// under to.
+func copyBucketAreas(tx *bbolt.Tx, from, to [][]byte, areas []string, nested bool) error {
+	fromKey, toKey := []byte(pathKey(from)), []byte(pathKey(to))
+	for _, area := range areas {
+		root := systemBucket(tx, area)
+		if root == nil {
+			continue
+		}
+		var names [][]byte
+		c := root.Cursor()
+		for k, _ := c.Seek(fromKey); k != nil && bytes.HasPrefix(k, fromKey); k, _ = c.Next() {
+			if len(k) == len(fromKey) || (nested && k[len(fromKey)] == '/') {
+				names = append(names, append([]byte(nil), k...))
+			}
+		}
+		for _, name := range names {
+			target := append(append([]byte(nil), toKey...), name[len(fromKey):]...)
+			if root.Bucket(name) == nil {
+				if err := root.Put(target, root.Get(name)); err != nil {
+					return err
+				}
+				continue
+			}
+			if root.Bucket(target) != nil {
+				if err := root.DeleteBucket(target); err != nil {
+					return err
+				}
+			}
+			dst, err := root.CreateBucket(target)
+			if err != nil {
+				return err
+			}
+			if _, err := copyBucketData(root.Bucket(name), dst, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildBucketIndexes rebuilds every index of the bucket at path.
+func rebuildBucketIndexes(tx *bbolt.Tx, path [][]byte, bucket *bbolt.Bucket) error {
+	indexes, err := loadIndexes(tx, path)
+	if err != nil {
+		return err
+	}
+	root := systemBucket(tx, indexesBucket, pathKey(path))
+	for _, idx := range indexes {
+		if err := idx.rebuild(root, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteKeys deletes the keys under prefix from the bucket at path.
+func deleteKeys(bucket *bbolt.Bucket, path [][]byte, prefix []byte) error {
+	var keys [][]byte
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if v != nil {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range keys {
+		if err := deleteRecord(bucket, path, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// scanPageSize caps the pairs a scan returns at once. A page is read
+// into memory before it is sent, so the store is not held open while a
+// slow client downloads it.
+var scanPageSize = 1000
+
+// scanItem is one key/value pair returned by a scan.
+type scanItem struct {
+	Key string `json:"key"`
+	itemValue
+}
+
+// scanBucket returns a page of the key/value pairs of a bucket. It accepts
+// the same range parameters as listKeys, with a limit of at most
+// scanPageSize, and reads the page from one read transaction, so it is a
+// consistent snapshot. The response is a JSON object by default, or NDJSON
+// (one pair per line, followed by a {"next": ...} line when more pairs
+// follow) with format=ndjson or Accept: application/x-ndjson.
+func scanBucket(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	kr, err := parseKeyRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if kr.limit == 0 || kr.limit > scanPageSize {
+		kr.limit = scanPageSize
+	}
+	ndjson := r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	items := []scanItem{}
+	var next []byte
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		now := time.Now()
+		var err error
+		next, err = kr.each(bucket.Cursor(), func(k, v []byte) (bool, error) {
+			if v == nil {
+				// Nested buckets have no value.
+				return false, nil
+			}
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return false, err
+			}
+			if rec.expired(now) {
+				return false, nil
+			}
+			item := scanItem{Key: string(k)}
+			item.fill(rec.clone())
+			items = append(items, item)
+			return true, nil
+		})
+		return err
+	})
+	release()
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if !ndjson {
+		w.Header().Set("Content-Type", "application/json")
+		enc.Encode(struct {
+			Items []scanItem `json:"items"`
+			Next  string     `json:"next,omitempty"`
+		}{items, string(next)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for _, item := range items {
+		enc.Encode(item)
+	}
+	if next != nil {
+		enc.Encode(map[string]string{"next": string(next)})
+	}
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.etcd.io/bbolt"
+)
+
+// schemasBucket maps bucket paths to the JSON Schema their values must
+// match. It lives inside the reserved bucket.
+const schemasBucket = "schemas"
+
+// maxCachedSchemas bounds the compiled schema cache. It is cleared when full.
+const maxCachedSchemas = 1024
+
+var (
+	errSchemaNotFound  = errors.New("schema not found")
+	errSchemaViolation = errors.New("value does not match the bucket schema")
+	errNoRemoteRefs    = errors.New("schemas cannot reference other documents")
+)
+
+// schemaError lists why a value does not match a schema.
+type schemaError struct {
+	violations []schemaViolation
+}
+
+// schemaViolation is one failed constraint, located by a JSON Pointer into
+// the value.
+type schemaViolation struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func (e *schemaError) Error() string {
+	var b strings.Builder
+	b.WriteString(errSchemaViolation.Error())
+	for _, v := range e.violations {
+		fmt.Fprintf(&b, "\n%s: %s", v.Path, v.Error)
+	}
+	return b.String()
+}
+
+func (e *schemaError) Unwrap() error {
+	return errSchemaViolation
+}
+
+// schemaCache holds compiled schemas by the hash of their source, so
+// writes do not compile the bucket schema every time.
+var schemaCache = struct {
+	sync.Mutex
+	schemas map[[sha256.Size]byte]*jsonschema.Schema
+}{schemas: make(map[[sha256.Size]byte]*jsonschema.Schema)}
+
+// compileSchema compiles a JSON Schema document. References to other
+// documents are refused, since resolving them would let a schema read
+// local files or make the server fetch URLs.
+func compileSchema(source []byte) (*jsonschema.Schema, error) {
+	sum := sha256.Sum256(source)
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+	if schema, ok := schemaCache.schemas[sum]; ok {
+		return schema, nil
+	}
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.LoadURL = func(string) (io.ReadCloser, error) {
+		return nil, errNoRemoteRefs
+	}
+	if err := c.AddResource("schema.json", bytes.NewReader(source)); err != nil {
+		return nil, err
+	}
+	schema, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, err
+	}
+	if len(schemaCache.schemas) >= maxCachedSchemas {
+		schemaCache.schemas = make(map[[sha256.Size]byte]*jsonschema.Schema)
+	}
+	schemaCache.schemas[sum] = schema
+	return schema, nil
+}
+
+// bucketSchema returns the compiled schema of the bucket at path, or nil
+// when it has none.
+func bucketSchema(tx *bbolt.Tx, path [][]byte) (*jsonschema.Schema, error) {
+	schemas := systemBucket(tx, schemasBucket)
+	if schemas == nil {
+		return nil, nil
+	}
+	source := schemas.Get([]byte(pathKey(path)))
+	if source == nil {
+		return nil, nil
+	}
+	return compileSchema(source)
+}
+
+// validateRecord checks rec against the schema of the bucket at path.
+// Buckets with a schema only accept JSON values.
+func validateRecord(tx *bbolt.Tx, path [][]byte, rec *record) error {
+	schema, err := bucketSchema(tx, path)
+	if err != nil || schema == nil {
+		return err
+	}
+	return validateValue(schema, rec)
+}
+
+func validateValue(schema *jsonschema.Schema, rec *record) error {
+	if rec.ContentType != "" {
+		return &schemaError{[]schemaViolation{{Path: "", Error: "value is not JSON"}}}
+	}
+	doc, err := decodeJSON(rec.Value)
+	if err != nil {
+		return err
+	}
+	var ve *jsonschema.ValidationError
+	if err := schema.Validate(doc); errors.As(err, &ve) {
+		return &schemaError{violations(ve)}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// violations flattens a validation error into its leaves, which name the
+// constraints that actually failed.
+func violations(ve *jsonschema.ValidationError) []schemaViolation {
+	if len(ve.Causes) == 0 {
+		return []schemaViolation{{Path: ve.InstanceLocation, Error: ve.Message}}
+	}
+	var list []schemaViolation
+	for _, cause := range ve.Causes {
+		list = append(list, violations(cause)...)
+	}
+	return list
+}
+
+// parseSchema validates and compiles a schema sent by a client.
+func parseSchema(source []byte) (*jsonschema.Schema, error) {
+	if !json.Valid(source) {
+		return nil, errors.New("schema must be a valid JSON document")
+	}
+	return compileSchema(source)
+}
+
+// setSchema attaches the JSON Schema in the body to the bucket. Later
+// writes are validated against it; values already stored are not, use
+// _schema/_validate to check them first.
+func setSchema(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseSchema(source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if getBucket(tx, path) == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		schemas, err := createSystemBucket(tx, schemasBucket)
+		if err != nil {
+			return err
+		}
+		return schemas.Put([]byte(pathKey(path)), source)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getSchema(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var source []byte
+	err = db.View(func(tx *bbolt.Tx) error {
+		if schemas := systemBucket(tx, schemasBucket); schemas != nil {
+			source = append(source, schemas.Get([]byte(pathKey(path)))...)
+		}
+		if source == nil {
+			return errSchemaNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(source)
+}
+
+func deleteSchema(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		schemas := systemBucket(tx, schemasBucket)
+		if schemas == nil || schemas.Get([]byte(pathKey(path))) == nil {
+			return errSchemaNotFound
+		}
+		return schemas.Delete([]byte(pathKey(path)))
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// invalidValue is a stored value that does not match a schema.
+type invalidValue struct {
+	Key        string            `json:"key"`
+	Violations []schemaViolation `json:"violations"`
+}
+
+// validateBucket checks every value of the bucket against the schema in
+// the body without storing it, or against the bucket's own schema when
+// the body is empty.
+func validateBucket(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var schema *jsonschema.Schema
+	if len(bytes.TrimSpace(source)) > 0 {
+		if schema, err = parseSchema(source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	checked := 0
+	invalid := []invalidValue{}
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		if schema == nil {
+			if schema, err = bucketSchema(tx, path); err != nil {
+				return err
+			}
+			if schema == nil {
+				return errSchemaNotFound
+			}
+		}
+		now := time.Now()
+		return bucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			rec, err := decodeRecord(v)
+			if err != nil || rec.expired(now) {
+				return err
+			}
+			checked++
+			var se *schemaError
+			if err := validateValue(schema, rec); errors.As(err, &se) {
+				invalid = append(invalid, invalidValue{Key: string(k), Violations: se.violations})
+			} else if err != nil {
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":   len(invalid) == 0,
+		"checked": checked,
+		"invalid": invalid,
+	})
+}
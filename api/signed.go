@@ -0,0 +1,281 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+// signingBucket holds the secret signed URLs of a store are verified
+// with. It lives inside the reserved bucket.
+const signingBucket = "signing"
+
+var signingSecretKey = []byte("secret")
+
+const (
+	// defaultSignedTTL is how long a signed URL is valid when no ttl is given.
+	defaultSignedTTL = time.Hour
+	// maxSignedTTL bounds the validity of a signed URL.
+	maxSignedTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errInvalidSignature = errors.New("invalid or expired signature")
+	errSignTarget       = errors.New("bucket and key are required, and the key cannot contain a slash")
+	errSignMethod       = errors.New("method must be GET, PUT, PATCH or DELETE")
+	errSignTTL          = fmt.Errorf("ttl cannot exceed %s", maxSignedTTL)
+)
+
+// signRequest is the body of POST /_sign.
+type signRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Method is the one method the URL may be used with; GET also allows
+	// HEAD. It defaults to GET.
+	Method string `json:"method"`
+	TTL    string `json:"ttl"`
+}
+
+// RegisterSignedRoutes registers the route serving signed URLs. It must be
+// mounted without ApiKeyMiddleware, since the signature replaces the key.
+func RegisterSignedRoutes(r *mux.Router) {
+	r.HandleFunc("/_signed/{owner:[0-9]+}/{bucketPath:.+}/{key}", serveSigned).
+		Methods("GET", "HEAD", "PUT", "PATCH", "DELETE")
+}
+
+// signature computes the signature of a URL for the key at bucket/key of
+// the store of owner. tokenID names the token that signed it, if any.
+func signature(secret []byte, method, owner, tokenID, bucket, key string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%d", method, owner, tokenID, bucket, key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingSecret returns the signing secret of the store, creating it when
+// create is set. It returns nil when the store has none.
+func signingSecret(tx *bbolt.Tx, create bool) ([]byte, error) {
+	if signing := systemBucket(tx, signingBucket); signing != nil {
+		if secret := signing.Get(signingSecretKey); secret != nil {
+			return append([]byte(nil), secret...), nil
+		}
+	}
+	if !create {
+		return nil, nil
+	}
+	signing, err := createSystemBucket(tx, signingBucket)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, signing.Put(signingSecretKey, secret)
+}
+
+// signURL mints a URL that gives access to a single key with one method
+// until it expires, without the API key. A token can only sign URLs for
+// what it may access itself, and not beyond its own expiry; the URL names
+// the token and stops working when it is revoked.
+func signURL(w http.ResponseWriter, r *http.Request) {
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := splitBucketPath(req.Bucket)
+	if err != nil || req.Key == "" || strings.Contains(req.Key, "/") {
+		http.Error(w, errSignTarget.Error(), http.StatusBadRequest)
+		return
+	}
+	if string(path[0]) == reservedBucket {
+		http.Error(w, "Bucket name 'system' not allowed", http.StatusBadRequest)
+		return
+	}
+	method := strings.ToUpper(req.Method)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		http.Error(w, errSignMethod.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultSignedTTL
+	if req.TTL != "" {
+		if ttl, err = parseDuration(req.TTL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ttl > maxSignedTTL {
+			http.Error(w, errSignTTL.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !authorize(w, r, path, method != http.MethodGet) {
+		return
+	}
+	expires := time.Now().Add(ttl).Unix()
+	var signer string
+	if tok := tokenFromRequest(r); tok != nil {
+		signer = tok.ID
+		if tok.ExpiresAt != 0 && expires > tok.ExpiresAt/1000 {
+			expires = tok.ExpiresAt / 1000
+		}
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var secret []byte
+	err = db.Update(func(tx *bbolt.Tx) error {
+		secret, err = signingSecret(tx, true)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t, _ := tenantFromRequest(r)
+	bucket := pathKey(path)
+	segments := []string{strings.TrimSuffix(r.URL.Path, "/_sign"), "_signed", t.id}
+	for _, name := range path {
+		segments = append(segments, string(name))
+	}
+	segments = append(segments, req.Key)
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {signature(secret, method, t.id, signer, bucket, req.Key, expires)},
+	}
+	if signer != "" {
+		query.Set("token", signer)
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	signed := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     strings.Join(segments, "/"),
+		RawQuery: query.Encode(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        signed.String(),
+		"method":     method,
+		"expires_at": expires * 1000,
+	})
+}
+
+// revokeSignedURLs replaces the signing secret of the store, which
+// invalidates every signed URL issued so far.
+func revokeSignedURLs(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if signing := systemBucket(tx, signingBucket); signing != nil {
+			return signing.Delete(signingSecretKey)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveSigned checks the signature of a signed URL and hands the request
+// to the handler of its method, as if it carried the store's API key.
+func serveSigned(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner, bucket, key := vars["owner"], vars["bucketPath"], vars["key"]
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		http.Error(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+	bucketName, _, _ := strings.Cut(bucket, "/")
+	if bucketName == reservedBucket {
+		http.Error(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+	t, ok := stores.lookup(owner)
+	if !ok {
+		http.Error(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+
+	db, release, err := pool.acquire(t.path)
+	if err != nil {
+		http.Error(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+	// A URL signed by a token is only valid while the token is.
+	signer := r.URL.Query().Get("token")
+	var secret []byte
+	var tok *token
+	err = db.View(func(tx *bbolt.Tx) error {
+		if secret, err = signingSecret(tx, false); err != nil || signer == "" {
+			return err
+		}
+		tok, err = lookupToken(tx, signer)
+		return err
+	})
+	release()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	want := signature(secret, method, owner, signer, bucket, key, expires)
+	if secret == nil || (signer != "" && tok == nil) || !hmac.Equal([]byte(want), []byte(r.URL.Query().Get("sig"))) {
+		http.Error(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+
+	r = withToken(withTenant(r, t), tok)
+	switch method {
+	case http.MethodGet:
+		getValue(w, r)
+	case http.MethodPut:
+		setKey(w, r)
+	case http.MethodPatch:
+		patchKey(w, r)
+	case http.MethodDelete:
+		deleteKey(w, r)
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// metaBucket maps bucket paths to their bucketMeta. It lives inside the
+// reserved bucket.
+const metaBucket = "meta"
+
+// bucketMeta records when a bucket was created and last written to, in
+// Unix milliseconds. Buckets created before it was introduced have no
+// creation time.
+type bucketMeta struct {
+	Created  int64 `json:"created,omitempty"`
+	Modified int64 `json:"modified,omitempty"`
+}
+
+func getBucketMeta(tx *bbolt.Tx, path [][]byte) (bucketMeta, error) {
+	var meta bucketMeta
+	metas := systemBucket(tx, metaBucket)
+	if metas == nil {
+		return meta, nil
+	}
+	data := metas.Get([]byte(pathKey(path)))
+	if data == nil {
+		return meta, nil
+	}
+	err := json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// updateBucketMeta applies fn to the metadata of the bucket at path.
+func updateBucketMeta(tx *bbolt.Tx, path [][]byte, fn func(meta *bucketMeta)) error {
+	meta, err := getBucketMeta(tx, path)
+	if err != nil {
+		return err
+	}
+	fn(&meta)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metas, err := createSystemBucket(tx, metaBucket)
+	if err != nil {
+		return err
+	}
+	return metas.Put([]byte(pathKey(path)), data)
+}
+
+// touchBucket sets the last-modified time of the bucket at path to now.
+func touchBucket(tx *bbolt.Tx, path [][]byte) error {
+	now := time.Now().UnixMilli()
+	return updateBucketMeta(tx, path, func(meta *bucketMeta) {
+		meta.Modified = now
+	})
+}
+
+// createUserBucket creates every missing bucket along path and records
+// the creation time of the ones it created. The names of the buckets it
+// creates must pass checkName.
+func createUserBucket(tx *bbolt.Tx, path [][]byte) error {
+	existing := 0
+	for existing < len(path) && getBucket(tx, path[:existing+1]) != nil {
+		existing++
+	}
+	for _, name := range path[existing:] {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
+	if _, err := createBucketPath(tx, path); err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for i := existing + 1; i <= len(path); i++ {
+		err := updateBucketMeta(tx, path[:i], func(meta *bucketMeta) {
+			meta.Created, meta.Modified = now, now
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketStats is the response of GET /{bucket}/_stats. Keys and
+// ValueBytes cover the bucket's own live keys; the page statistics come
+// from bbolt and include nested buckets.
+type bucketStats struct {
+	Keys       int        `json:"keys"`
+	Buckets    int        `json:"buckets"`
+	ValueBytes int64      `json:"value_bytes"`
+	Created    *time.Time `json:"created,omitempty"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Pages      pageStats  `json:"pages"`
+}
+
+type pageStats struct {
+	Depth             int `json:"depth"`
+	BranchPages       int `json:"branch_pages"`
+	BranchOverflow    int `json:"branch_overflow_pages"`
+	LeafPages         int `json:"leaf_pages"`
+	LeafOverflow      int `json:"leaf_overflow_pages"`
+	BranchAllocBytes  int `json:"branch_alloc_bytes"`
+	BranchInuseBytes  int `json:"branch_inuse_bytes"`
+	LeafAllocBytes    int `json:"leaf_alloc_bytes"`
+	LeafInuseBytes    int `json:"leaf_inuse_bytes"`
+	InlineBuckets     int `json:"inline_buckets"`
+	InlineBucketBytes int `json:"inline_bucket_inuse_bytes"`
+}
+
+// storeStats is the response of GET /_stats.
+type storeStats struct {
+	FileSize      int64 `json:"file_size"`
+	DataSize      int64 `json:"data_size"`
+	PageSize      int   `json:"page_size"`
+	FreePages     int   `json:"free_pages"`
+	PendingPages  int   `json:"pending_pages"`
+	FreeBytes     int   `json:"free_bytes"`
+	FreelistBytes int   `json:"freelist_bytes"`
+	Buckets       int   `json:"buckets"`
+}
+
+func getBucketStats(w http.ResponseWriter, r *http.Request) {
+	path, err := bucketPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	var stats bucketStats
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		now := time.Now()
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v == nil {
+				stats.Buckets++
+				continue
+			}
+			// Only the value counts, not the metadata stored with it.
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if !rec.expired(now) {
+				stats.Keys++
+				stats.ValueBytes += int64(len(rec.Value))
+			}
+		}
+
+		s := bucket.Stats()
+		stats.Pages = pageStats{
+			Depth:             s.Depth,
+			BranchPages:       s.BranchPageN,
+			BranchOverflow:    s.BranchOverflowN,
+			LeafPages:         s.LeafPageN,
+			LeafOverflow:      s.LeafOverflowN,
+			BranchAllocBytes:  s.BranchAlloc,
+			BranchInuseBytes:  s.BranchInuse,
+			LeafAllocBytes:    s.LeafAlloc,
+			LeafInuseBytes:    s.LeafInuse,
+			InlineBuckets:     s.InlineBucketN,
+			InlineBucketBytes: s.InlineBucketInuse,
+		}
+
+		meta, err := getBucketMeta(tx, path)
+		if meta.Created != 0 {
+			created := time.UnixMilli(meta.Created).UTC()
+			stats.Created = &created
+		}
+		if meta.Modified != 0 {
+			modified := time.UnixMilli(meta.Modified).UTC()
+			stats.Modified = &modified
+		}
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func getStoreStats(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, nil, false) {
+		return
+	}
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbStats := db.Stats()
+	stats := storeStats{
+		FileSize:      info.Size(),
+		PageSize:      db.Info().PageSize,
+		FreePages:     dbStats.FreePageN,
+		PendingPages:  dbStats.PendingPageN,
+		FreeBytes:     dbStats.FreeAlloc,
+		FreelistBytes: dbStats.FreelistInuse,
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		stats.DataSize = tx.Size()
+		return walkBuckets(tx, func([][]byte, *bbolt.Bucket) error {
+			stats.Buckets++
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,356 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+// tokensBucket holds the scoped tokens of a store, keyed by the SHA-256
+// of the token so the store file never contains them in clear. It lives
+// inside the reserved bucket.
+const tokensBucket = "tokens"
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+const accessContextKey contextKey = tenantContextKey + 1
+
+var (
+	errForbidden     = errors.New("Forbidden: the API key does not grant this access")
+	errTokenNotFound = errors.New("token not found")
+	errInvalidScope  = errors.New("scope must be read or write")
+)
+
+// token is an additional credential for a store with limited access. It
+// looks like an API key, so it carries the owner ID that locates the store.
+type token struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Scope string `json:"scope"`
+	// Buckets and Prefix restrict the token to the listed buckets (and the
+	// buckets nested in them) and to the bucket paths starting with Prefix.
+	// Without either it may access every bucket.
+	Buckets []string `json:"buckets,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+	// Created and ExpiresAt are Unix milliseconds; zero means no expiry.
+	Created   int64 `json:"created"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// allowsBucket reports whether the token may access the bucket at path.
+func (tok *token) allowsBucket(path [][]byte) bool {
+	if tok.allowsAll() {
+		return true
+	}
+	key := pathKey(path)
+	for _, bucket := range tok.Buckets {
+		if key == bucket || strings.HasPrefix(key, bucket+"/") {
+			return true
+		}
+	}
+	return tok.Prefix != "" && strings.HasPrefix(key, tok.Prefix)
+}
+
+func (tok *token) allowsAll() bool {
+	return len(tok.Buckets) == 0 && tok.Prefix == ""
+}
+
+// authenticate resolves an API key to its store. The store's own key and
+// its additional keys grant full access and yield a nil token; any other
+// key must be a live token of the store.
+func authenticate(apiKey string) (*tenant, *token, error) {
+	t, primary, err := stores.resolve(apiKey)
+	if err != nil || primary {
+		return t, nil, err
+	}
+	db, release, err := pool.acquire(t.path)
+	if err != nil {
+		return nil, nil, errInvalidApiKey
+	}
+	defer release()
+
+	var tok *token
+	err = db.View(func(tx *bbolt.Tx) error {
+		// Additional keys grant full access, like the store's own key.
+		if ok, err := lookupApiKey(tx, apiKey); ok || err != nil {
+			return err
+		}
+		var err error
+		if tok, err = lookupToken(tx, tokenID(apiKey)); err == nil && tok == nil {
+			return errInvalidApiKey
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, tok, nil
+}
+
+// lookupToken returns the token of the store with the given ID, or nil
+// when it does not exist or has expired.
+func lookupToken(tx *bbolt.Tx, id string) (*token, error) {
+	tokens := systemBucket(tx, tokensBucket)
+	if tokens == nil {
+		return nil, nil
+	}
+	data := tokens.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	tok := &token{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, err
+	}
+	if tok.ExpiresAt != 0 && tok.ExpiresAt <= time.Now().UnixMilli() {
+		return nil, nil
+	}
+	return tok, nil
+}
+
+// tokenID derives the stored identifier of a token or additional key.
+func tokenID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func withToken(r *http.Request, tok *token) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessContextKey, tok))
+}
+
+// tokenFromRequest returns the token a request was authenticated with,
+// or nil when it used one of the store's full-access keys.
+func tokenFromRequest(r *http.Request) *token {
+	tok, _ := r.Context().Value(accessContextKey).(*token)
+	return tok
+}
+
+// checkAccess is the part of authorization ApiKeyMiddleware can decide
+// from the route alone: the bucket in the URL and, for methods that only
+// write, the scope. Handlers behind POST check writes themselves with
+// authorize, since POST is also used for reads.
+func checkAccess(r *http.Request, tok *token) error {
+	if tok == nil {
+		return nil
+	}
+	if v, ok := mux.Vars(r)["bucketPath"]; ok {
+		path, err := splitBucketPath(v)
+		if err == nil && !tok.allowsBucket(path) {
+			return errForbidden
+		}
+	}
+	switch r.Method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		if tok.Scope != scopeWrite {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the request may access the bucket at path, for
+// writing when write is set. A nil path stands for the whole store, which
+// only tokens without bucket restrictions may access.
+func allowed(r *http.Request, path [][]byte, write bool) bool {
+	tok := tokenFromRequest(r)
+	if tok == nil {
+		return true
+	}
+	if write && tok.Scope != scopeWrite {
+		return false
+	}
+	if path == nil {
+		return tok.allowsAll()
+	}
+	return tok.allowsBucket(path)
+}
+
+// authorize is allowed for handlers: it answers 403 and returns false
+// when the request may not access the bucket at path.
+func authorize(w http.ResponseWriter, r *http.Request, path [][]byte, write bool) bool {
+	if !allowed(r, path, write) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// tokenRequest is the body of POST /_tokens.
+type tokenRequest struct {
+	Name    string   `json:"name"`
+	Scope   string   `json:"scope"`
+	Buckets []string `json:"buckets"`
+	Prefix  string   `json:"prefix"`
+	TTL     string   `json:"ttl"`
+}
+
+// createToken issues a scoped token. Tokens are managed with the store's
+// full-access keys only. The secret is returned once and only its hash is kept.
+func createToken(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Scope != scopeRead && req.Scope != scopeWrite {
+		http.Error(w, errInvalidScope.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, bucket := range req.Buckets {
+		if _, err := splitBucketPath(bucket); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	tok := &token{
+		Name:    req.Name,
+		Scope:   req.Scope,
+		Buckets: req.Buckets,
+		Prefix:  req.Prefix,
+		Created: now.UnixMilli(),
+	}
+	if req.TTL != "" {
+		ttl, err := parseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tok.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+
+	t, _ := tenantFromRequest(r)
+	secret, err := newSecret(t.id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tok.ID = tokenID(secret)
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		tokens, err := createSystemBucket(tx, tokensBucket)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		return tokens.Put([]byte(tok.ID), data)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+		*token
+	}{secret, tok})
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	list := []token{}
+	err = db.View(func(tx *bbolt.Tx) error {
+		tokens := systemBucket(tx, tokensBucket)
+		if tokens == nil {
+			return nil
+		}
+		return tokens.ForEach(func(_, data []byte) error {
+			var tok token
+			if err := json.Unmarshal(data, &tok); err != nil {
+				return err
+			}
+			list = append(list, tok)
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]token{"tokens": list})
+}
+
+// revokeToken deletes a token, which stops working immediately.
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOwner(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		tokens := systemBucket(tx, tokensBucket)
+		if tokens == nil || tokens.Get([]byte(id)) == nil {
+			return errTokenNotFound
+		}
+		return tokens.Delete([]byte(id))
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorizeOwner answers 403 unless the request used a full-access key.
+func authorizeOwner(w http.ResponseWriter, r *http.Request) bool {
+	if tokenFromRequest(r) != nil {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// newSecret generates a credential in the API key format for owner id.
+func newSecret(id string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return id + "-" + hex.EncodeToString(b), nil
+}
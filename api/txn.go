@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// txnRequest is the body of POST /_txn: a list of operations executed in
+// one bbolt transaction. Either every operation is applied or none is.
+type txnRequest struct {
+	Ops []txnOp `json:"ops"`
+}
+
+// txnOp is a single put, delete or check. Checks only assert preconditions
+// and fail the whole transaction when they do not hold.
+type txnOp struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	TTL    string          `json:"ttl,omitempty"`
+
+	// Preconditions, usable on any operation.
+	Exists *bool           `json:"exists,omitempty"`
+	Equals json.RawMessage `json:"equals,omitempty"`
+	ETag   string          `json:"etag,omitempty"`
+}
+
+type txnResult struct {
+	ETag string `json:"etag,omitempty"`
+}
+
+// txnError reports which operation aborted a transaction.
+type txnError struct {
+	index  int
+	status int
+	err    error
+}
+
+func (e *txnError) Error() string {
+	return fmt.Sprintf("Operation %d: %s", e.index, e.err)
+}
+
+var (
+	errTxnExists   = errors.New("key existence does not match")
+	errTxnEquals   = errors.New("value does not match")
+	errTxnETag     = errors.New("etag does not match")
+	errTxnValue    = errors.New("value must be a valid JSON document")
+	errTxnUnknown  = errors.New("unknown op, expected put, delete or check")
+	errTxnNoTarget = errors.New("bucket and key are required")
+)
+
+func runTransaction(w http.ResponseWriter, r *http.Request) {
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	prepared := make([]*preparedOp, len(req.Ops))
+	for i := range req.Ops {
+		op, err := prepareTxnOp(&req.Ops[i], now)
+		if err != nil {
+			http.Error(w, (&txnError{index: i, err: err}).Error(), http.StatusBadRequest)
+			return
+		}
+		if !allowed(r, op.path, req.Ops[i].Op != "check") {
+			http.Error(w, (&txnError{index: i, err: errForbidden}).Error(), http.StatusForbidden)
+			return
+		}
+		prepared[i] = op
+	}
+
+	db, release, err := openDb(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	results := make([]txnResult, len(req.Ops))
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for i, op := range req.Ops {
+			bucket := getBucket(tx, prepared[i].path)
+			if bucket == nil {
+				return &txnError{index: i, status: http.StatusNotFound, err: bbolt.ErrBucketNotFound}
+			}
+			current, err := getRecord(bucket, []byte(op.Key))
+			if err != nil {
+				return &txnError{index: i, status: http.StatusInternalServerError, err: err}
+			}
+			if err := checkTxnOp(&op, current); err != nil {
+				return &txnError{index: i, status: http.StatusPreconditionFailed, err: err}
+			}
+
+			switch op.Op {
+			case "put":
+				err = putRecord(bucket, prepared[i].path, []byte(op.Key), prepared[i].rec)
+				results[i].ETag = prepared[i].rec.etag()
+			case "delete":
+				err = deleteRecord(bucket, prepared[i].path, []byte(op.Key))
+			case "check":
+				if current != nil {
+					results[i].ETag = current.etag()
+				}
+			}
+			if err != nil {
+				return &txnError{index: i, status: errorStatus(err), err: err}
+			}
+		}
+		return nil
+	})
+	var opErr *txnError
+	if errors.As(err, &opErr) {
+		http.Error(w, opErr.Error(), opErr.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]txnResult{"results": results})
+}
+
+// preparedOp is a validated operation: the parsed bucket path and, for
+// puts, the record to store.
+type preparedOp struct {
+	path [][]byte
+	rec  *record
+}
+
+// prepareTxnOp checks an operation before the transaction starts.
+func prepareTxnOp(op *txnOp, now time.Time) (*preparedOp, error) {
+	if op.Bucket == "" || op.Key == "" {
+		return nil, errTxnNoTarget
+	}
+	path, err := splitBucketPath(op.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if string(path[0]) == reservedBucket {
+		return nil, fmt.Errorf("bucket '%s' not allowed", reservedBucket)
+	}
+	prepared := &preparedOp{path: path}
+	switch op.Op {
+	case "put":
+		if len(op.Value) == 0 || !json.Valid(op.Value) {
+			return nil, errTxnValue
+		}
+		prepared.rec = &record{Value: op.Value}
+		if op.TTL != "" {
+			ttl, err := parseDuration(op.TTL)
+			if err != nil {
+				return nil, err
+			}
+			prepared.rec.ExpiresAt = now.Add(ttl).UnixMilli()
+		}
+	case "delete", "check":
+	default:
+		return nil, errTxnUnknown
+	}
+	return prepared, nil
+}
+
+// checkTxnOp evaluates the preconditions of op against the current value.
+func checkTxnOp(op *txnOp, current *record) error {
+	if op.Exists != nil && *op.Exists != (current != nil) {
+		return errTxnExists
+	}
+	if op.ETag != "" && (current == nil || current.etag() != op.ETag) {
+		return errTxnETag
+	}
+	if len(op.Equals) > 0 {
+		if current == nil || current.ContentType != "" || !jsonEqual(current.Value, op.Equals) {
+			return errTxnEquals
+		}
+	}
+	return nil
+}
+
+// jsonEqual reports whether two JSON documents hold the same value,
+// ignoring formatting and object key order.
+func jsonEqual(a, b []byte) bool {
+	va, errA := decodeJSON(a)
+	vb, errB := decodeJSON(b)
+	return errA == nil && errB == nil && jsonValuesEqual(va, vb)
+}
@@ -0,0 +1,441 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// wsMaxMessageSize bounds the messages a WebSocket client may send.
+	wsMaxMessageSize int64 = 1 << 20
+	// wsWriteTimeout bounds how long a single message may take to send.
+	wsWriteTimeout = 10 * time.Second
+)
+
+var (
+	errWsUnknownOp      = errors.New("op must be subscribe, unsubscribe, get, set or delete")
+	errWsNoTarget       = errors.New("bucket and key are required")
+	errWsValue          = errors.New("value must be a valid JSON document")
+	errWsSubscribed     = errors.New("a subscription with this id already exists")
+	errWsNotSubscribed  = errors.New("subscription not found")
+	errWsReservedBucket = errors.New("Bucket name 'system' not allowed")
+	errWsNoID           = errors.New("id is required")
+)
+
+const (
+	// wsProtocol is the subprotocol the server selects. Browsers cannot set
+	// headers on a WebSocket, so they offer it together with a second one,
+	// wsKeyProtocol followed by the API key.
+	wsProtocol    = "kvrest"
+	wsKeyProtocol = "key."
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{wsProtocol},
+	CheckOrigin:  checkOrigin,
+}
+
+// checkOrigin accepts clients that are not browsers, which send no Origin,
+// pages of the API's own origin and the origins listed, comma-separated,
+// in WS_ALLOWED_ORIGINS ("*" allows any).
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestApiKey returns the API key of a request: the API-KEY header or,
+// for a WebSocket handshake, the key offered as a subprotocol.
+func requestApiKey(r *http.Request) string {
+	if apiKey := r.Header.Get("API-KEY"); apiKey != "" || !websocket.IsWebSocketUpgrade(r) {
+		return apiKey
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if apiKey, ok := strings.CutPrefix(protocol, wsKeyProtocol); ok {
+			return apiKey
+		}
+	}
+	return ""
+}
+
+// wsRequest is a message from the client. ID correlates it with the
+// response and, for subscribe, names the subscription.
+type wsRequest struct {
+	ID     string `json:"id"`
+	Op     string `json:"op"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Prefix and LastEventID configure a subscription like the prefix
+	// parameter and Last-Event-ID header of GET /{bucket}/_changes.
+	Prefix      string `json:"prefix"`
+	LastEventID string `json:"last_event_id"`
+	// Subscription is the ID of the subscription to end.
+	Subscription string          `json:"subscription"`
+	Value        json.RawMessage `json:"value"`
+	TTL          string          `json:"ttl"`
+}
+
+// wsResponse answers the request with the same ID. A value is returned
+// like in batch responses.
+type wsResponse struct {
+	ID     string `json:"id"`
+	OK     bool   `json:"ok"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	itemValue
+}
+
+// wsEvent delivers a change to a subscription. Reset tells the client that
+// events were missed, or the bucket was replaced as a whole, and it should
+// reload; Closed that the subscription
+// fell behind and ended, and may be renewed with the last EventID.
+type wsEvent struct {
+	Subscription string       `json:"subscription"`
+	EventID      string       `json:"event_id,omitempty"`
+	Event        *changeEvent `json:"event,omitempty"`
+	Reset        bool         `json:"reset,omitempty"`
+	Closed       bool         `json:"closed,omitempty"`
+}
+
+// wsConn is a WebSocket connection serving one client. Requests are
+// handled in order; a single writer sends responses and events. done is
+// closed when the reader stops, writerDone when the writer does. r is
+// only used by the reader, which refreshes it from apiKey per request.
+type wsConn struct {
+	r          *http.Request
+	apiKey     string
+	conn       *websocket.Conn
+	out        chan interface{}
+	done       chan struct{}
+	writerDone chan struct{}
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+	wg   sync.WaitGroup
+}
+
+// serveWebSocket upgrades the connection to a WebSocket that multiplexes
+// change subscriptions and get/set/delete requests. It is authenticated
+// by ApiKeyMiddleware like every other route, and a token's scope applies
+// to each request.
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request.
+		return
+	}
+	c := &wsConn{
+		r:          r,
+		apiKey:     requestApiKey(r),
+		conn:       conn,
+		out:        make(chan interface{}, changeBufferSize),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+		subs:       make(map[string]*subscription),
+	}
+	go c.writeLoop()
+	c.readLoop()
+
+	close(c.done)
+	c.mu.Lock()
+	for id, sub := range c.subs {
+		delete(c.subs, id)
+		sub.feed.unsubscribe(sub)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	conn.Close()
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * changeHeartbeat))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(2 * changeHeartbeat))
+	})
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.send(wsResponse{Status: http.StatusBadRequest, Error: err.Error()})
+				continue
+			}
+			return
+		}
+		c.handle(&req)
+	}
+}
+
+// writeLoop sends queued messages and pings the client while it is idle.
+// When a write fails it closes the connection, which also ends readLoop.
+func (c *wsConn) writeLoop() {
+	defer close(c.writerDone)
+	ping := time.NewTicker(changeHeartbeat)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			// Idle connections are checked here, so subscriptions
+			// also end once the credential is revoked or expires.
+			if _, _, err := authenticate(c.apiKey); err == errInvalidApiKey {
+				c.closeUnauthorized()
+				return
+			}
+			deadline := time.Now().Add(wsWriteTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// authenticate checks the connection's credential again, so a revoked or
+// expired token or key stops working on open connections too, and
+// refreshes the token whose scope applies to the request. It closes the
+// connection when the credential is no longer valid.
+func (c *wsConn) authenticate() error {
+	t, tok, err := authenticate(c.apiKey)
+	if err == errInvalidApiKey {
+		c.closeUnauthorized()
+	}
+	if err != nil {
+		return err
+	}
+	c.r = withToken(withTenant(c.r, t), tok)
+	return nil
+}
+
+// closeUnauthorized ends the connection with a policy violation, which
+// also ends readLoop.
+func (c *wsConn) closeUnauthorized() {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, errInvalidApiKey.Error())
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+	c.conn.Close()
+}
+
+// send queues a message unless the connection is closing.
+func (c *wsConn) send(msg interface{}) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	case <-c.writerDone:
+	}
+}
+
+// handle answers a request. Responses are queued in the order requests
+// arrive, and a subscription's events after its response.
+func (c *wsConn) handle(req *wsRequest) {
+	if req.ID == "" {
+		c.send(wsError(req, http.StatusBadRequest, errWsNoID))
+		return
+	}
+	if err := c.authenticate(); err == errInvalidApiKey {
+		return
+	} else if err != nil {
+		c.send(wsError(req, http.StatusInternalServerError, err))
+		return
+	}
+	if req.Op == "unsubscribe" {
+		c.send(c.unsubscribe(req))
+		return
+	}
+
+	path, err := splitBucketPath(req.Bucket)
+	if err != nil {
+		c.send(wsError(req, http.StatusBadRequest, err))
+		return
+	}
+	if string(path[0]) == reservedBucket {
+		c.send(wsError(req, http.StatusMethodNotAllowed, errWsReservedBucket))
+		return
+	}
+	write := req.Op == "set" || req.Op == "delete"
+	if !allowed(c.r, path, write) {
+		c.send(wsError(req, http.StatusForbidden, errForbidden))
+		return
+	}
+
+	switch req.Op {
+	case "subscribe":
+		db, release, err := openDb(c.r)
+		if err != nil {
+			c.send(wsError(req, errorStatus(err), err))
+			return
+		}
+		err = db.View(func(tx *bbolt.Tx) error {
+			if getBucket(tx, path) == nil {
+				return bbolt.ErrBucketNotFound
+			}
+			return nil
+		})
+		release()
+		if err != nil {
+			c.send(wsError(req, errorStatus(err), err))
+			return
+		}
+		c.subscribe(req, path)
+	case "get", "set", "delete":
+		if req.Key == "" {
+			c.send(wsError(req, http.StatusBadRequest, errWsNoTarget))
+			return
+		}
+		db, release, err := openDb(c.r)
+		if err != nil {
+			c.send(wsError(req, errorStatus(err), err))
+			return
+		}
+		defer release()
+		if req.Op == "get" {
+			c.send(getForWs(db, req, path))
+		} else {
+			c.send(writeForWs(db, req, path))
+		}
+	default:
+		c.send(wsError(req, http.StatusBadRequest, errWsUnknownOp))
+	}
+}
+
+func wsError(req *wsRequest, status int, err error) wsResponse {
+	return wsResponse{ID: req.ID, Status: status, Error: err.Error()}
+}
+
+func (c *wsConn) subscribe(req *wsRequest, path [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[req.ID]; ok {
+		c.send(wsError(req, http.StatusConflict, errWsSubscribed))
+		return
+	}
+	t, _ := tenantFromRequest(c.r)
+	sub, backlog, reset := subscribeChanges(t.id, pathKey(path), req.Prefix, req.LastEventID)
+	c.subs[req.ID] = sub
+	c.send(wsResponse{ID: req.ID, OK: true})
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if reset {
+			c.send(wsEvent{Subscription: req.ID, Reset: true})
+		}
+		for _, ev := range backlog {
+			c.send(wsEvent{Subscription: req.ID, EventID: ev.id, Event: ev, Reset: ev.Type == "reset"})
+		}
+		for ev := range sub.events {
+			c.send(wsEvent{Subscription: req.ID, EventID: ev.id, Event: ev, Reset: ev.Type == "reset"})
+		}
+		// The channel is closed by an unsubscribe, which removes the
+		// subscription first, or by the feed when the client fell behind.
+		c.mu.Lock()
+		dropped := c.subs[req.ID] == sub
+		if dropped {
+			delete(c.subs, req.ID)
+		}
+		c.mu.Unlock()
+		if dropped {
+			c.send(wsEvent{Subscription: req.ID, Closed: true})
+		}
+	}()
+}
+
+func (c *wsConn) unsubscribe(req *wsRequest) wsResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub, ok := c.subs[req.Subscription]
+	if !ok {
+		return wsError(req, http.StatusNotFound, errWsNotSubscribed)
+	}
+	delete(c.subs, req.Subscription)
+	sub.feed.unsubscribe(sub)
+	return wsResponse{ID: req.ID, OK: true}
+}
+
+func getForWs(db *bbolt.DB, req *wsRequest, path [][]byte) wsResponse {
+	var rec *record
+	err := db.View(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		stored, err := getRecord(bucket, []byte(req.Key))
+		if stored != nil {
+			rec = stored.clone()
+		}
+		return err
+	})
+	if err != nil {
+		return wsError(req, errorStatus(err), err)
+	}
+	if rec == nil {
+		return wsError(req, http.StatusNotFound, errKeyNotFound)
+	}
+	resp := wsResponse{ID: req.ID, OK: true}
+	resp.fill(rec)
+	return resp
+}
+
+// writeForWs sets or deletes a key. Set only accepts JSON values.
+func writeForWs(db *bbolt.DB, req *wsRequest, path [][]byte) wsResponse {
+	var rec *record
+	if req.Op == "set" {
+		if len(req.Value) == 0 || !json.Valid(req.Value) {
+			return wsError(req, http.StatusBadRequest, errWsValue)
+		}
+		rec = &record{Value: req.Value}
+		if req.TTL != "" {
+			ttl, err := parseDuration(req.TTL)
+			if err != nil {
+				return wsError(req, http.StatusBadRequest, err)
+			}
+			rec.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+		}
+	}
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		bucket := getBucket(tx, path)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		if rec == nil {
+			return deleteRecord(bucket, path, []byte(req.Key))
+		}
+		return putRecord(bucket, path, []byte(req.Key), rec)
+	})
+	if err != nil {
+		return wsError(req, errorStatus(err), err)
+	}
+	resp := wsResponse{ID: req.ID, OK: true}
+	if rec != nil {
+		resp.ETag = rec.etag()
+	}
+	return resp
+}
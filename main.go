@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -21,6 +22,9 @@ func main() {
 		}
 	}
 
+	// Delete expired keys in the background
+	go api.StartExpirySweeper(time.Minute)
+
 	// Start the Telegram bot in a separate goroutine
 	if os.Getenv("BOT_TOKEN") != "" {
 		go telegram_bot.StartBot()
@@ -29,6 +33,10 @@ func main() {
 	// Define the main router
 	router := mux.NewRouter()
 
+	// Signed URLs are verified by their signature instead of the API key,
+	// so they are routed before the API middlewares apply
+	api.RegisterSignedRoutes(router.PathPrefix("/api").Subrouter())
+
 	// Define the subrouter for API with both middlewares
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	api.RegisterRoutes(apiRouter)
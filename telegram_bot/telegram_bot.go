@@ -4,11 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"html"
 	"io/ioutil"
+	"kvrest/api"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go.etcd.io/bbolt"
@@ -38,7 +41,15 @@ func StartBot() {
 		},
 		tgbotapi.BotCommand{
 			Command:     "change_api_key",
-			Description: "Allows the user to change their existing API key. It generates a new API key, renames the BoltDB file with the new key, and sends the new API key to the user.",
+			Description: "Generates a new API key and sends it to the user. The previous key keeps working for a grace period (24h by default, or the duration given, 0 to revoke it at once).",
+		},
+		tgbotapi.BotCommand{
+			Command:     "api_keys",
+			Description: "Lists the API keys of the user's KV store, with their IDs and expiry.",
+		},
+		tgbotapi.BotCommand{
+			Command:     "revoke_api_key",
+			Description: "Revokes the API key with the given ID, which stops working immediately.",
 		},
 		tgbotapi.BotCommand{
 			Command:     "view_bucket_keys",
@@ -70,6 +81,12 @@ func StartBot() {
 			case "change_api_key":
 				handleChangeApiKey(bot, update.Message)
 
+			case "api_keys":
+				handleListApiKeys(bot, update.Message)
+
+			case "revoke_api_key":
+				handleRevokeApiKey(bot, update.Message)
+
 			case "view_bucket_keys":
 				handleViewBucketKeys(bot, update.Message)
 
@@ -112,12 +129,14 @@ func handleCreateKV(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 	}
 
 	// Create the BoltDB file
-	db, err := bbolt.Open(filepath.Join(dataPath, fmt.Sprintf("%d-%s.db", userID, apiKey)), 0666, nil)
+	dbFile := filepath.Join(dataPath, fmt.Sprintf("%d-%s.db", userID, apiKey))
+	db, err := bbolt.Open(dbFile, 0666, nil)
 	if err != nil {
 		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to create database file"))
 		return
 	}
-	defer db.Close()
+	db.Close()
+	api.RegisterStore(dbFile)
 
 	response := fmt.Sprintf("Your API key is: `%s`", fmt.Sprintf("%d-%s", userID, apiKey))
 	responseMsg := tgbotapi.NewMessage(msg.Chat.ID, response)
@@ -146,26 +165,117 @@ func handleChangeApiKey(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 		return
 	}
 
-	newApiKey, err := generateAPIKey()
-	if err != nil {
-		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to generate new API key"))
-		return
+	grace := 24 * time.Hour
+	if commandArgs := strings.Fields(msg.Text); len(commandArgs) > 1 {
+		grace, err = time.ParseDuration(commandArgs[1])
+		if err != nil || grace < 0 {
+			responseMsg := tgbotapi.NewMessage(msg.Chat.ID, "Please give the grace period as a duration, e.g. `/change_api_key 1h`, or `0` to revoke the old key at once")
+			responseMsg.ParseMode = "Markdown"
+			bot.Send(responseMsg)
+			return
+		}
 	}
 
-	oldDbFile := filepath.Join(dataPath, userDB)
-	newDbFile := filepath.Join(dataPath, fmt.Sprintf("%d-%s.db", userID, newApiKey))
-	err = os.Rename(oldDbFile, newDbFile)
+	newApiKey, err := api.RotateApiKey(filepath.Join(dataPath, userDB), grace)
 	if err != nil {
-		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to rename database file"))
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to change API key"))
 		return
 	}
 
-	response := fmt.Sprintf("Your new API key is: `%s`", fmt.Sprintf("%d-%s", userID, newApiKey))
+	response := fmt.Sprintf("Your new API key is: `%s`", newApiKey)
+	if grace > 0 {
+		response += fmt.Sprintf("\nThe previous key keeps working for %s. Use /api\\_keys and /revoke\\_api\\_key to revoke it earlier.", grace)
+	}
 	responseMsg := tgbotapi.NewMessage(msg.Chat.ID, response)
 	responseMsg.ParseMode = "Markdown"
 	bot.Send(responseMsg)
 }
 
+func handleListApiKeys(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	userID := msg.From.ID
+	fileNamePrefix := fmt.Sprintf("%d-", userID)
+
+	var userDB string
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), fileNamePrefix) {
+			userDB = file.Name()
+			break
+		}
+	}
+
+	if userDB == "" {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "You don't have a KV store. Use /start to create one."))
+		return
+	}
+
+	keys, err := api.ListApiKeys(filepath.Join(dataPath, userDB))
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Error listing API keys: %s", err.Error())))
+		return
+	}
+
+	var keyList string
+	for _, key := range keys {
+		keyList += fmt.Sprintf("- <code>%s</code>", key.ID)
+		switch {
+		case key.Primary:
+			keyList += " (primary)"
+		case key.Name != "":
+			keyList += fmt.Sprintf(" (%s)", html.EscapeString(key.Name))
+		}
+		if key.ExpiresAt != 0 {
+			keyList += fmt.Sprintf(", expires %s", time.UnixMilli(key.ExpiresAt).UTC().Format(time.RFC3339))
+		}
+		keyList += "\n"
+	}
+
+	responseMsg := tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Your API keys:\n%s", keyList))
+	responseMsg.ParseMode = "HTML"
+	bot.Send(responseMsg)
+}
+
+func handleRevokeApiKey(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	userID := msg.From.ID
+	fileNamePrefix := fmt.Sprintf("%d-", userID)
+
+	var userDB string
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), fileNamePrefix) {
+			userDB = file.Name()
+			break
+		}
+	}
+
+	if userDB == "" {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "You don't have a KV store. Use /start to create one."))
+		return
+	}
+
+	commandArgs := strings.Fields(msg.Text)
+	if len(commandArgs) < 2 {
+		responseMsg := tgbotapi.NewMessage(msg.Chat.ID, "Please specify the key ID from /api\\_keys using `/revoke_api_key KEY_ID`")
+		responseMsg.ParseMode = "Markdown"
+		bot.Send(responseMsg)
+		return
+	}
+
+	err = api.RevokeApiKey(filepath.Join(dataPath, userDB), commandArgs[1])
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Error: %s", err.Error())))
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "The API key was revoked."))
+}
+
 func handleViewBucketKeys(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 	userID := msg.From.ID
 	fileNamePrefix := fmt.Sprintf("%d-", userID)
@@ -197,12 +307,12 @@ func handleViewBucketKeys(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 	}
 	bucketName := commandArgs[1]
 
-	db, err := bbolt.Open(filepath.Join(dataPath, userDB), 0666, nil)
+	db, release, err := api.OpenStore(filepath.Join(dataPath, userDB))
 	if err != nil {
 		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to open database file"))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	var bucketContent string
 	err = db.View(func(tx *bbolt.Tx) error {
@@ -251,12 +361,12 @@ func handleListBuckets(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 		return
 	}
 
-	db, err := bbolt.Open(filepath.Join(dataPath, userDB), 0666, nil)
+	db, release, err := api.OpenStore(filepath.Join(dataPath, userDB))
 	if err != nil {
 		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Failed to open database file."))
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	var bucketList string
 	err = db.View(func(tx *bbolt.Tx) error {
@@ -340,7 +450,17 @@ Displays the documentation for all available commands to the user.
 Creates a new key-value (KV) store for the user. It generates a unique API key and creates a new BoltDB file to store the user's data. The API key is then sent back to the user.
 
 <b>/change_api_key</b>
-Allows the user to change their existing API key. It generates a new API key, renames the BoltDB file with the new key, and sends the new API key to the user.
+Generates a new API key and sends it to the user. The previous key keeps working for a grace period, 24 hours by default, so deployed services can be switched over.
+
+<i>Usage:</i> <code>/change_api_key <b>[GRACE]</b></code>, e.g. <code>/change_api_key 1h</code>, or <code>/change_api_key 0</code> to revoke the previous key at once
+
+<b>/api_keys</b>
+Lists the API keys of your KV store, with their IDs and expiry.
+
+<b>/revoke_api_key</b>
+Revokes an API key, which stops working immediately.
+
+<i>Usage:</i> <code>/revoke_api_key <b>KEY_ID</b></code>
 
 <b>/view_bucket_keys</b>
 Allows the user to view the keys stored in a specific bucket within their KV store. The user needs to provide the name of the bucket they want to view.